@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	"github.com/stephane-martin/vssh/commands"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/vault"
 	"github.com/stephane-martin/vssh/widgets"
 
 	"github.com/gabriel-vasile/mimetype"
@@ -28,6 +31,9 @@ func App() *cli.App {
 		commands.ResolveCommand(),
 		commands.SocksCommand(),
 		commands.HTTPProxyCommand(),
+		commands.CertCommand(),
+		commands.AgentCommand(),
+		commands.ProfileCommand(),
 		{
 			Name:  "version",
 			Usage: "print vssh version",
@@ -75,27 +81,83 @@ func App() *cli.App {
 		},
 	}
 	app.Flags = GlobalFlags()
+	app.Before = func(c *cli.Context) error {
+		err := params.ApplyProfile(c)
+		if err != nil {
+			// exit right away, as urfave/cli prints the usage after the
+			// errors of Before
+			cli.HandleExitCoder(cli.NewExitError(err.Error(), 1))
+			return err
+		}
+		return nil
+	}
 	return app
 }
 
 // GlobalFlags returns the global flags for vssh.
 func GlobalFlags() []cli.Flag {
 	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "name of the profile to use from the configuration file",
+			EnvVar: "VSSH_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "vssh configuration file",
+			EnvVar: "VSSH_CONFIG",
+			Value:  params.DefaultConfigFile,
+		},
 		cli.StringFlag{
 			Name:   "vault-address,vault-addr",
 			Value:  "http://127.0.0.1:8200",
 			EnvVar: "VAULT_ADDR",
 			Usage:  "the address of the Vault server",
 		},
+		cli.StringFlag{
+			Name:   "vault-namespace,namespace",
+			Usage:  "Vault Enterprise namespace",
+			Value:  "",
+			EnvVar: "VAULT_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "vault-cacert",
+			Usage:  "path to a PEM-encoded CA certificate to verify the Vault server certificate",
+			Value:  "",
+			EnvVar: "VAULT_CACERT",
+		},
+		cli.StringFlag{
+			Name:   "vault-capath",
+			Usage:  "path to a directory of PEM-encoded CA certificates to verify the Vault server certificate",
+			Value:  "",
+			EnvVar: "VAULT_CAPATH",
+		},
+		cli.StringFlag{
+			Name:   "vault-tls-server-name",
+			Usage:  "name to use as the SNI host when connecting to Vault",
+			Value:  "",
+			EnvVar: "VAULT_TLS_SERVER_NAME",
+		},
+		cli.BoolFlag{
+			Name:   "vault-skip-verify",
+			Usage:  "do not verify the Vault server certificate (insecure)",
+			EnvVar: "VAULT_SKIP_VERIFY",
+		},
 		cli.StringFlag{
 			Name:   "vault-token,token",
 			Value:  "",
 			EnvVar: "VAULT_TOKEN",
 			Usage:  "Vault authentication token",
 		},
+		cli.StringFlag{
+			Name:   "vault-token-helper",
+			Usage:  "executable that stores the Vault token between runs (default: token_helper in ~/.vault, or else ~/.vault-token)",
+			Value:  "",
+			EnvVar: "VAULT_TOKEN_HELPER",
+		},
 		cli.StringFlag{
 			Name:   "vault-auth-method,vault-method,method",
-			Usage:  "type of authentication",
+			Usage:  "type of authentication [token, userpass, ldap, approle, jwt, oidc, kubernetes, cert]",
 			Value:  "token",
 			EnvVar: "VAULT_AUTH_METHOD",
 		},
@@ -105,6 +167,12 @@ func GlobalFlags() []cli.Flag {
 			Value:  "",
 			EnvVar: "VAULT_AUTH_PATH",
 		},
+		cli.StringFlag{
+			Name:   "vault-auth-role",
+			Usage:  "Vault role for the jwt, oidc, kubernetes and cert authentication methods",
+			Value:  "",
+			EnvVar: "VAULT_AUTH_ROLE",
+		},
 		cli.StringFlag{
 			Name:   "vault-username",
 			Usage:  "Vault username or RoleID",
@@ -117,6 +185,36 @@ func GlobalFlags() []cli.Flag {
 			Value:  "",
 			EnvVar: "VAULT_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "vault-jwt",
+			Usage:  "JWT for the jwt authentication method",
+			Value:  "",
+			EnvVar: "VAULT_JWT",
+		},
+		cli.StringFlag{
+			Name:   "vault-kubernetes-token-file",
+			Usage:  "path to the service account token for the kubernetes authentication method",
+			Value:  vault.DefaultKubernetesTokenFile,
+			EnvVar: "VAULT_KUBERNETES_TOKEN_FILE",
+		},
+		cli.StringFlag{
+			Name:   "vault-client-cert",
+			Usage:  "path to the TLS client certificate for Vault, also used by the cert authentication method",
+			Value:  "",
+			EnvVar: "VAULT_CLIENT_CERT",
+		},
+		cli.StringFlag{
+			Name:   "vault-client-key",
+			Usage:  "path to the private key of the TLS client certificate for Vault",
+			Value:  "",
+			EnvVar: "VAULT_CLIENT_KEY",
+		},
+		cli.IntFlag{
+			Name:   "vault-oidc-port",
+			Usage:  "local port that receives the OIDC callback from the browser",
+			Value:  8250,
+			EnvVar: "VAULT_OIDC_PORT",
+		},
 		cli.StringFlag{
 			Name:   "vault-ssh-mount,mount",
 			Usage:  "Vault SSH signer mount point",
@@ -129,11 +227,48 @@ func GlobalFlags() []cli.Flag {
 			EnvVar: "VAULT_SSH_ROLE",
 		},
 		cli.StringFlag{
-			Name:   "http-proxy,httpproxy",
-			Usage:  "specify a URL to connect through a HTTP proxy",
+			Name:   "vault-ssh-mode",
+			Usage:  "mode of the Vault SSH secrets engine: ca (signed certificates) or otp (one-time passwords)",
+			EnvVar: "VAULT_SSH_MODE",
+			Value:  "ca",
+		},
+		cli.StringFlag{
+			Name:   "vault-ssh-host-mount,host-mount",
+			Usage:  "Vault SSH host signer mount point, to verify the host certificates",
+			EnvVar: "VAULT_SSH_HOST_MOUNT",
+		},
+		cli.StringFlag{
+			Name:   "host-map",
+			Usage:  "file that maps host patterns to the Vault SSH mount and role, login, port and private key",
+			EnvVar: "VSSH_HOST_MAP",
+			Value:  params.DefaultHostMapFile,
+		},
+		cli.StringFlag{
+			Name:   "ssh-config,F",
+			Usage:  "OpenSSH client configuration file, or none (default: ~/.ssh/config and /etc/ssh/ssh_config)",
+			EnvVar: "VSSH_SSH_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "jump-host,J",
+			Usage:  "connect through the jump hosts, like [user@]host[:port][,...], or none (default: ProxyJump from ssh_config)",
+			EnvVar: "VSSH_JUMP_HOST",
+		},
+		cli.StringFlag{
+			Name:   "revoked-host-keys",
+			Usage:  "file of revoked host keys and host certificate authorities, in the authorized_keys format",
+			EnvVar: "VSSH_REVOKED_HOST_KEYS",
+		},
+		cli.StringFlag{
+			Name:   "http-proxy,httpproxy,proxy",
+			Usage:  "connect through a proxy, given by a http://, https:// or socks5:// URL (default: $ALL_PROXY)",
 			Value:  "",
 			EnvVar: "SSH_HTTP_PROXY",
 		},
+		cli.StringFlag{
+			Name:   "proxy-secret",
+			Usage:  "path of a Vault secret with the username and password fields for the proxy",
+			EnvVar: "VSSH_PROXY_SECRET",
+		},
 		cli.StringFlag{
 			Name:   "login,l",
 			Usage:  "SSH remote user",
@@ -145,11 +280,10 @@ func GlobalFlags() []cli.Flag {
 			EnvVar: "SSH_PORT",
 			Value:  22,
 		},
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:   "privkey,private,identity,i",
-			Usage:  "filesystem path to SSH private key",
+			Usage:  "filesystem path to SSH private key (multiple times, default: ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa and ~/.ssh/id_rsa)",
 			EnvVar: "IDENTITY",
-			Value:  "",
 		},
 		cli.StringFlag{
 			Name:   "vprivkey,vprivate,videntity",
@@ -172,6 +306,52 @@ func GlobalFlags() []cli.Flag {
 			Usage:  "enable SSH agent authentication",
 			EnvVar: "VSSH_SSH_AGENT",
 		},
+		cli.StringFlag{
+			Name:   "agent-key",
+			Usage:  "with --agent, fingerprint or comment of the agent key to sign with Vault (default: the first agent key)",
+			EnvVar: "VSSH_SSH_AGENT_KEY",
+		},
+		cli.BoolFlag{
+			Name:   "no-cert-cache",
+			Usage:  "do not cache the certificates signed by Vault",
+			EnvVar: "VSSH_NO_CERT_CACHE",
+		},
+		cli.DurationFlag{
+			Name:   "cert-ttl",
+			Usage:  "requested lifetime of the certificates signed by Vault (default: the Vault role TTL)",
+			EnvVar: "VSSH_CERT_TTL",
+		},
+		cli.StringSliceFlag{
+			Name:   "principal",
+			Usage:  "additional principal for the certificates signed by Vault (can be repeated)",
+			EnvVar: "VSSH_CERT_PRINCIPALS",
+		},
+		cli.StringSliceFlag{
+			Name:   "extension",
+			Usage:  "extension for the certificates signed by Vault, like permit-pty or permit-port-forwarding (can be repeated)",
+			EnvVar: "VSSH_CERT_EXTENSIONS",
+		},
+		cli.StringSliceFlag{
+			Name:   "critical-option",
+			Usage:  "critical option for the certificates signed by Vault, like source-address=10.0.0.0/8 (can be repeated)",
+			EnvVar: "VSSH_CERT_CRITICAL_OPTIONS",
+		},
+		cli.StringFlag{
+			Name:   "key-id",
+			Usage:  "key ID of the certificates signed by Vault, if the Vault role allows it",
+			EnvVar: "VSSH_CERT_KEY_ID",
+		},
+		cli.BoolFlag{
+			Name:   "ephemeral",
+			Usage:  "authenticate with a new in-memory private key, signed by Vault for a short time",
+			EnvVar: "VSSH_EPHEMERAL",
+		},
+		cli.DurationFlag{
+			Name:   "ephemeral-ttl",
+			Usage:  "lifetime of the certificates of the ephemeral keys",
+			EnvVar: "VSSH_EPHEMERAL_TTL",
+			Value:  5 * time.Minute,
+		},
 		cli.StringFlag{
 			Name:  "loglevel",
 			Usage: "logging level",
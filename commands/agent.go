@@ -0,0 +1,196 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+
+	"github.com/urfave/cli"
+	"golang.org/x/sync/errgroup"
+)
+
+func AgentCommand() cli.Command {
+	return cli.Command{
+		Name:   "agent",
+		Usage:  "serve the private keys and their Vault certificates with the ssh-agent protocol",
+		Action: agentAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "socket,a",
+				Usage:  "bind the agent to this Unix socket path (default: random path in a temp directory)",
+				EnvVar: "VSSH_AGENT_SOCKET",
+			},
+			cli.BoolFlag{
+				Name:  "csh,c",
+				Usage: "print C-shell commands instead of Bourne shell commands",
+			},
+			cli.BoolFlag{
+				Name:  "foreground,D",
+				Usage: "stay in the foreground instead of running in the background",
+			},
+		},
+	}
+}
+
+// agentChildEnv is set in the environment of the agent started in the
+// background. The agent writes the shell commands to the file descriptor 3.
+const agentChildEnv = "VSSH_AGENT_CHILD"
+
+func agentAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+
+	child := os.Getenv(agentChildEnv) != ""
+	if !child && !clictx.Bool("foreground") {
+		return startAgent()
+	}
+	_ = os.Unsetenv(agentChildEnv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	gparams := params.Params{
+		LogLevel: strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))),
+	}
+
+	logger, err := params.Logger(gparams.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	c := params.NewCliContext(clictx)
+	login := c.SSHLogin()
+	if login == "" {
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		login = u.Username
+	}
+
+	client, credentials, err := crypto.GetSSHCredentials(ctx, c, login, false, logger)
+	if err != nil {
+		return err
+	}
+	signOpts, err := crypto.GetSignOptions(c)
+	if err != nil {
+		return err
+	}
+	vagent := lib.NewVaultAgent(credentials, login, params.GetVaultParams(c), signOpts, client, logger)
+	if vagent.Len() == 0 {
+		return errors.New("no private key to serve")
+	}
+
+	socket := clictx.String("socket")
+	if socket == "" {
+		dir, err := ioutil.TempDir("", "vssh-agent")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary directory: %s", err)
+		}
+		defer func() { _ = os.RemoveAll(dir) }()
+		socket = filepath.Join(dir, fmt.Sprintf("agent.%d", os.Getpid()))
+	}
+	socket, err = filepath.Abs(socket)
+	if err != nil {
+		return err
+	}
+
+	listener, err := lib.ListenAgent(socket)
+	if err != nil {
+		return err
+	}
+
+	// the shell commands are printed once the socket is ready
+	out := os.Stdout
+	if child {
+		out = os.NewFile(3, "agent output")
+	}
+	if clictx.Bool("csh") {
+		fmt.Fprintf(out, "setenv SSH_AUTH_SOCK %s;\n", socket)
+		fmt.Fprintf(out, "setenv SSH_AGENT_PID %d;\n", os.Getpid())
+	} else {
+		fmt.Fprintf(out, "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", sys.EscapeString(socket))
+		fmt.Fprintf(out, "SSH_AGENT_PID=%d; export SSH_AGENT_PID;\n", os.Getpid())
+	}
+	fmt.Fprintf(out, "echo Agent pid %d;\n", os.Getpid())
+	if child {
+		_ = out.Close()
+		err = sys.Detach()
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("failed to detach the agent: %s", err)
+		}
+	} else {
+		_ = out.Sync()
+	}
+
+	g, lctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return vagent.Serve(lctx, listener)
+	})
+	g.Go(func() error {
+		return vagent.Renew(lctx)
+	})
+	logger.Infow("agent listening", "socket", socket)
+	err = g.Wait()
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// startAgent runs the agent again in the background, like ssh-agent does, so
+// that eval "$(vssh agent)" returns. The agent in the background unlocks the
+// private keys, so it keeps the terminal until it prints the shell commands.
+// Its standard output goes to stderr, as the standard output is evaluated by
+// the shell.
+func startAgent() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), agentChildEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		_ = r.Close()
+		return fmt.Errorf("failed to start the agent: %s", err)
+	}
+	n, _ := io.Copy(os.Stdout, r)
+	_ = r.Close()
+	if n > 0 {
+		return nil
+	}
+	// the agent exits without printing anything when it fails
+	err = cmd.Wait()
+	if err == nil {
+		err = errors.New("the agent exited")
+	}
+	return fmt.Errorf("failed to start the agent: %s", err)
+}
@@ -0,0 +1,427 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/urfave/cli"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+func CertCommand() cli.Command {
+	return cli.Command{
+		Name:  "cert",
+		Usage: "manage the certificates signed by Vault",
+		Subcommands: []cli.Command{
+			{
+				Name:      "show",
+				Usage:     "print the certificates that would be used to connect",
+				ArgsUsage: "[[user@]host]",
+				Action:    certShowAction,
+			},
+			{
+				Name:      "write",
+				Usage:     "write the private key, the public key and the certificate to files",
+				ArgsUsage: "[[user@]host]",
+				Action:    certWriteAction,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "output,o",
+						Usage: "path of the private key; the certificate is written to PATH-cert.pub",
+						Value: "id",
+					},
+					cli.BoolFlag{
+						Name:  "force,f",
+						Usage: "overwrite existing files",
+					},
+					cli.BoolFlag{
+						Name:  "unencrypted-key",
+						Usage: "write the private key, even though it is not encrypted",
+					},
+				},
+			},
+			{
+				Name:      "check",
+				Usage:     "check that a certificate is valid to connect to the host",
+				ArgsUsage: "[user@]host",
+				Action:    certCheckAction,
+			},
+			{
+				Name:  "cache",
+				Usage: "manage the local cache of signed certificates",
+				Subcommands: []cli.Command{
+					{
+						Name:   "list",
+						Usage:  "list the cached certificates",
+						Action: certCacheListAction,
+					},
+					{
+						Name:   "purge",
+						Usage:  "remove the cached certificates",
+						Action: certCachePurgeAction,
+						Flags: []cli.Flag{
+							cli.BoolFlag{
+								Name:  "expired",
+								Usage: "only remove the expired certificates",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func fmtValidity(t time.Time) string {
+	if t.IsZero() {
+		return "forever"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// vaultName shows the Vault server and namespace of a cache entry.
+func vaultName(entry *crypto.CachedCertificate) string {
+	if entry.Namespace == "" {
+		return entry.Address
+	}
+	return entry.Address + " (" + entry.Namespace + ")"
+}
+
+func certCacheListAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+	cache, err := crypto.OpenCertCache()
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	entries, err := cache.List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FINGERPRINT\tPRINCIPAL\tVAULT\tMOUNT\tROLE\tVALID BEFORE\tSTATUS")
+	for _, entry := range entries {
+		status := "valid"
+		if entry.Expired() {
+			status = "expired"
+		} else if entry.NotYetValid() {
+			status = "not yet valid"
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Fingerprint, entry.Principal, vaultName(entry), entry.Mount, entry.Role, fmtValidity(entry.ValidBefore), status,
+		)
+	}
+	return w.Flush()
+}
+
+func certCachePurgeAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+	cache, err := crypto.OpenCertCache()
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	count, err := cache.Purge(clictx.Bool("expired"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d certificate(s)\n", count)
+	return nil
+}
+
+type certCredentials struct {
+	credentials crypto.SSHCredentials
+	cert        *ssh.Certificate
+}
+
+// getCertificates returns the credentials that have a certificate, in the
+// order they would be used to connect. If the host is given, the host
+// mapping applies.
+func getCertificates(ctx context.Context, c params.CLIContext, l *zap.SugaredLogger) (string, []certCredentials, error) {
+	var login string
+	if c.SSHHost() != "" {
+		sshParams, err := params.GetSSHParams(c)
+		if err != nil {
+			return "", nil, err
+		}
+		login = sshParams.LoginName
+	} else {
+		login = c.SSHLogin()
+		if login == "" {
+			u, err := user.Current()
+			if err != nil {
+				return "", nil, err
+			}
+			login = u.Username
+		}
+	}
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, login, c.SSHAgent(), l)
+	if err != nil {
+		return "", nil, err
+	}
+	var certs []certCredentials
+	for _, cred := range credentials {
+		if cred.Certificate == nil {
+			continue
+		}
+		cert, err := gssh.ParseCertificate(cred.Certificate.Buffer())
+		if err != nil {
+			l.Warnw("failed to parse certificate", "error", err)
+			continue
+		}
+		certs = append(certs, certCredentials{credentials: cred, cert: cert})
+	}
+	if len(certs) == 0 {
+		return login, nil, errors.New("no certificate")
+	}
+	return login, certs, nil
+}
+
+func certAction(clictx *cli.Context, f func(context.Context, params.CLIContext, *zap.SugaredLogger) error) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	logger, err := params.Logger(strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	return f(ctx, params.NewCliContext(clictx), logger)
+}
+
+func fmtList(values []string) string {
+	if len(values) == 0 {
+		return "(none)"
+	}
+	return strings.Join(values, ", ")
+}
+
+func fmtOptions(options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name, value := range options {
+		if value != "" {
+			name = name + "=" + value
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmtList(names)
+}
+
+func printCertificate(w io.Writer, cert *ssh.Certificate) {
+	typ := "user"
+	if cert.CertType == ssh.HostCert {
+		typ = "host"
+	}
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	if cert.ValidAfter == 0 {
+		validAfter = time.Time{}
+	}
+	validBefore := certValidBefore(cert)
+	fmt.Fprintf(w, "Type:             %s %s certificate\n", cert.Type(), typ)
+	fmt.Fprintf(w, "Public key:       %s %s\n", cert.Key.Type(), ssh.FingerprintSHA256(cert.Key))
+	fmt.Fprintf(w, "Signing CA:       %s %s\n", cert.SignatureKey.Type(), ssh.FingerprintSHA256(cert.SignatureKey))
+	fmt.Fprintf(w, "Key ID:           %q\n", cert.KeyId)
+	fmt.Fprintf(w, "Serial:           %d\n", cert.Serial)
+	if validAfter.IsZero() {
+		fmt.Fprintf(w, "Valid:            from always to %s\n", fmtValidity(validBefore))
+	} else {
+		fmt.Fprintf(w, "Valid:            from %s to %s\n", fmtValidity(validAfter), fmtValidity(validBefore))
+	}
+	fmt.Fprintf(w, "Principals:       %s\n", fmtList(cert.ValidPrincipals))
+	fmt.Fprintf(w, "Critical options: %s\n", fmtOptions(cert.CriticalOptions))
+	fmt.Fprintf(w, "Extensions:       %s\n", fmtOptions(cert.Extensions))
+}
+
+func certShowAction(clictx *cli.Context) error {
+	return certAction(clictx, func(ctx context.Context, c params.CLIContext, l *zap.SugaredLogger) error {
+		_, certs, err := getCertificates(ctx, c, l)
+		if err != nil {
+			return err
+		}
+		for i, cert := range certs {
+			if i > 0 {
+				fmt.Println()
+			}
+			printCertificate(os.Stdout, cert.cert)
+		}
+		return nil
+	})
+}
+
+func writeNewFile(path string, content []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	return err
+}
+
+func certWriteAction(clictx *cli.Context) error {
+	return certAction(clictx, func(ctx context.Context, c params.CLIContext, l *zap.SugaredLogger) error {
+		_, certs, err := getCertificates(ctx, c, l)
+		if err != nil {
+			return err
+		}
+		// the first certificate is the one that would be tried first
+		cert := certs[0]
+		output := strings.TrimSpace(clictx.String("output"))
+		if output == "" {
+			return errors.New("empty output path")
+		}
+		force := clictx.Bool("force")
+		if cert.credentials.PrivateKey != nil && !clictx.Bool("unencrypted-key") {
+			// the key may have been decrypted, or never have been on the disk
+			return errors.New("the private key would be written unencrypted, use --unencrypted-key to write it anyway")
+		}
+		if cert.credentials.PrivateKey != nil {
+			err := writeNewFile(output, cert.credentials.PrivateKey.Buffer(), 0600, force)
+			if err != nil {
+				return fmt.Errorf("failed to write private key: %s", err)
+			}
+			fmt.Fprintf(os.Stderr, "private key written to %s\n", output)
+		} else {
+			// the private key stays in the SSH agent
+			fmt.Fprintln(os.Stderr, "the private key is held by the SSH agent, it is not written")
+		}
+		err = writeNewFile(output+".pub", ssh.MarshalAuthorizedKey(cert.cert.Key), 0644, force)
+		if err != nil {
+			return fmt.Errorf("failed to write public key: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "public key written to %s.pub\n", output)
+		// copy the certificate, the memguard buffer is read-only
+		certb := append([]byte(nil), bytes.TrimSpace(cert.credentials.Certificate.Buffer())...)
+		certb = append(certb, '\n')
+		err = writeNewFile(output+"-cert.pub", certb, 0644, force)
+		if err != nil {
+			return fmt.Errorf("failed to write certificate: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "certificate written to %s-cert.pub\n", output)
+		return nil
+	})
+}
+
+// checkCertificate returns the reasons why the certificate can't be used to
+// log in as login.
+func checkCertificate(cert *ssh.Certificate, login string, now time.Time) []string {
+	var problems []string
+	if cert.CertType != ssh.UserCert {
+		problems = append(problems, "this is not a user certificate")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		problems = append(problems, "the certificate has no principal, sshd rejects it: check the allowed_users of the Vault role")
+	} else {
+		found := false
+		for _, principal := range cert.ValidPrincipals {
+			if principal == login {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf(
+				"the remote user %s is not a principal of the certificate (%s): check the allowed_users of the Vault role, or use --login",
+				login, strings.Join(cert.ValidPrincipals, ", "),
+			))
+		}
+	}
+	unixNow := uint64(now.Unix())
+	if unixNow < cert.ValidAfter {
+		problems = append(problems, fmt.Sprintf("the certificate is not valid before %s", fmtValidity(time.Unix(int64(cert.ValidAfter), 0))))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unixNow >= cert.ValidBefore {
+		problems = append(problems, fmt.Sprintf("the certificate expired at %s", fmtValidity(time.Unix(int64(cert.ValidBefore), 0))))
+	}
+	return problems
+}
+
+func certCheckAction(clictx *cli.Context) error {
+	return certAction(clictx, func(ctx context.Context, c params.CLIContext, l *zap.SugaredLogger) error {
+		if c.SSHHost() == "" {
+			return errors.New("no host given")
+		}
+		login, certs, err := getCertificates(ctx, c, l)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		var valid int
+		for i, cert := range certs {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("certificate %q (%s):\n", cert.cert.KeyId, ssh.FingerprintSHA256(cert.cert.Key))
+			problems := checkCertificate(cert.cert, login, now)
+			if len(problems) == 0 {
+				valid++
+				fmt.Printf("  OK for %s, valid until %s\n", login, fmtValidity(certValidBefore(cert.cert)))
+				if len(cert.cert.CriticalOptions) > 0 {
+					fmt.Printf("  the server enforces: %s\n", fmtOptions(cert.cert.CriticalOptions))
+				}
+				continue
+			}
+			for _, problem := range problems {
+				fmt.Printf("  %s\n", problem)
+			}
+		}
+		if valid == 0 {
+			return fmt.Errorf("no valid certificate for %s", login)
+		}
+		return nil
+	})
+}
+
+func certValidBefore(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}
+	}
+	return time.Unix(int64(cert.ValidBefore), 0)
+}
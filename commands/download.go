@@ -134,16 +134,11 @@ func wrapGet(sftp bool) cli.ActionFunc {
 		if len(sources) == 0 {
 			var paths []entry
 
-			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+			methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 			if err != nil {
 				return err
 			}
 
-			methods := crypto.CredentialsToMethods(credentials, logger)
-			if len(methods) == 0 {
-				return errors.New("no usable credentials")
-			}
-
 			err = lib.SFTPListAuth(ctx, sshParams, methods, logger, func(path, rel string, isdir bool) error {
 				if strings.HasPrefix(rel, ".") {
 					if isdir {
@@ -172,14 +167,10 @@ func wrapGet(sftp bool) cli.ActionFunc {
 			}
 		}
 
-		_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+		methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 		if err != nil {
 			return err
 		}
-		methods := crypto.CredentialsToMethods(credentials, logger)
-		if len(methods) == 0 {
-			return errors.New("no usable credentials")
-		}
 
 		var f getFunc
 		if sftp {
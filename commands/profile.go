@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/stephane-martin/vssh/params"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli"
+)
+
+func ProfileCommand() cli.Command {
+	return cli.Command{
+		Name:  "profile",
+		Usage: "show the profiles of the configuration file",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list the profiles",
+				Action: profileListAction,
+			},
+			{
+				Name:      "show",
+				Usage:     "print the options of a profile (default: the current profile)",
+				ArgsUsage: "[name]",
+				Action:    profileShowAction,
+			},
+		},
+	}
+}
+
+func profileListAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+	c := params.NewCliContext(clictx)
+	profiles, err := params.ReadProfiles(c.ConfigFile())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\tPROFILE\tVAULT ADDRESS\tSSH MOUNT\tSSH ROLE")
+	for _, name := range params.ProfileNames(profiles) {
+		current := ""
+		if name == c.Profile() {
+			current = "*"
+		}
+		p := profiles[name]
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\n",
+			current, name, profileOption(p, "vault-address"), profileOption(p, "vault-ssh-mount"), profileOption(p, "vault-ssh-role"),
+		)
+	}
+	return w.Flush()
+}
+
+func profileOption(p params.Profile, name string) string {
+	if v, ok := p[name]; ok {
+		return fmt.Sprintf("%v", v)
+	}
+	return "-"
+}
+
+func profileShowAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+	c := params.NewCliContext(clictx)
+	name := c.Profile()
+	if len(clictx.Args()) > 0 {
+		name = clictx.Args()[0]
+	}
+	if name == "" {
+		return errors.New("specify the profile name, or select a profile with --profile")
+	}
+	profiles, err := params.ReadProfiles(c.ConfigFile())
+	if err != nil {
+		return err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("profile not found: %s", name)
+	}
+	shown := make(params.Profile, len(profile))
+	for option, value := range profile {
+		shown[option] = params.ShownOption(option, value)
+	}
+	fmt.Printf("# profile %s\n", name)
+	return toml.NewEncoder(os.Stdout).Encode(shown)
+}
@@ -80,14 +80,10 @@ func BrowseCommand() cli.Command {
 			defer cancel()
 			sys.CancelOnSignal(cancel)
 
-			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+			methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 			if err != nil {
 				return err
 			}
-			methods := crypto.CredentialsToMethods(credentials, logger)
-			if len(methods) == 0 {
-				return errors.New("no usable credentials")
-			}
 
 			client, err := lib.SFTPClient(sshParams, methods, logger)
 			if err != nil {
@@ -178,14 +174,10 @@ func SFTPCommand() cli.Command {
 				return err
 			}
 
-			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+			methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 			if err != nil {
 				return err
 			}
-			methods := crypto.CredentialsToMethods(credentials, logger)
-			if len(methods) == 0 {
-				return errors.New("no usable credentials")
-			}
 
 			client, err := lib.SFTPClient(sshParams, methods, logger)
 			if err != nil {
@@ -371,14 +363,10 @@ func SFTPCommand() cli.Command {
 						return err
 					}
 
-					_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+					methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 					if err != nil {
 						return err
 					}
-					methods := crypto.CredentialsToMethods(credentials, logger)
-					if len(methods) == 0 {
-						return errors.New("no usable credentials")
-					}
 
 					cb := func(isDir, endOfDir bool, name string, perms os.FileMode, mtime, atime time.Time, content io.Reader) error {
 						if isDir {
@@ -442,14 +430,10 @@ func SFTPCommand() cli.Command {
 						return err
 					}
 
-					_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+					methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 					if err != nil {
 						return err
 					}
-					methods := crypto.CredentialsToMethods(credentials, logger)
-					if len(methods) == 0 {
-						return errors.New("no usable credentials")
-					}
 
 					hidden := clictx.Bool("hidden")
 					aur := aurora.NewAurora(clictx.Bool("color"))
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/remoteops"
 	"github.com/stephane-martin/vssh/sys"
@@ -15,7 +16,6 @@ import (
 	"github.com/getlantern/go-socks5"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/hidden"
-	gssh "github.com/stephane-martin/golang-ssh"
 	"github.com/urfave/cli"
 )
 
@@ -70,28 +70,12 @@ func socksAction(clictx *cli.Context) (e error) {
 		return err
 	}
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 	if err != nil {
 		return err
 	}
-	methods := crypto.CredentialsToMethods(credentials, logger)
-	if len(methods) == 0 {
-		return errors.New("no usable credentials")
-	}
 
-	cfg := gssh.Config{
-		User:      sshParams.LoginName,
-		Host:      sshParams.Host,
-		Port:      sshParams.Port,
-		Auth:      methods,
-		HTTPProxy: sshParams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, sshParams, methods, logger)
 	if err != nil {
 		return err
 	}
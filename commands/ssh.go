@@ -3,6 +3,7 @@ package commands
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"strings"
@@ -32,15 +33,33 @@ func SSHCommand() cli.Command {
 				Usage:  "use the native SSH client instead of the builtin one",
 				EnvVar: "SSH_NATIVE",
 			},
+			cli.StringSliceFlag{
+				Name:  "option,o",
+				Usage: "option for the native SSH client, like ServerAliveInterval=30 (multiple times)",
+			},
 			cli.BoolFlag{
 				Name:   "terminal,t",
 				Usage:  "force pseudo-terminal allocation",
 				EnvVar: "SSH_FORCE_PSEUDO",
 			},
+			cli.BoolFlag{
+				Name:  "no-terminal,T",
+				Usage: "disable pseudo-terminal allocation",
+			},
+			cli.StringFlag{
+				Name:  "escape-char,e",
+				Usage: "escape character for interactive sessions, or none to disable it",
+				Value: "~",
+			},
 			cli.StringSliceFlag{
 				Name:  "secret,key",
 				Usage: "path of a secret to be read from Vault (multiple times)",
 			},
+			cli.StringFlag{
+				Name:   "secret-mode",
+				Usage:  "how the secrets are given to the remote command: setenv, file or stdin (default: file, setenv with --native)",
+				EnvVar: "VSSH_SECRET_MODE",
+			},
 			cli.BoolFlag{
 				Name:   "upcase,up",
 				Usage:  "convert all environment variable keys to uppercase",
@@ -57,8 +76,10 @@ func SSHCommand() cli.Command {
 
 func sshAction(clictx *cli.Context) (e error) {
 	defer func() {
+		// exit like OpenSSH, with the exit status of the remote command
 		if e != nil {
-			e = cli.NewExitError(e.Error(), 1)
+			status, msg := lib.ExitStatus(e)
+			e = cli.NewExitError(msg, status)
 		}
 	}()
 
@@ -103,16 +124,14 @@ func sshAction(clictx *cli.Context) (e error) {
 		return err
 	}
 
-	methods := crypto.CredentialsToMethods(credentials, logger)
-	if len(methods) == 0 {
-		return errors.New("no usable credentials")
-	}
-
 	secretPaths := clictx.StringSlice("secret")
 	var secrets map[string]string
 	if len(secretPaths) > 0 {
 		if client == nil {
-			return errors.New("can't read secrets from vault: no vault client")
+			client, err = vault.GetVaultClient(ctx, params.GetVaultParams(c), logger)
+			if err != nil {
+				return fmt.Errorf("can't read secrets from vault: %s", err)
+			}
 		}
 		res, err := vault.GetSecretsFromVault(ctx, client, secretPaths, gparams.Prefix, gparams.Upcase, logger)
 		if err != nil {
@@ -121,6 +140,45 @@ func sshAction(clictx *cli.Context) (e error) {
 		secrets = res
 	}
 
-	// TODO: restore native connect
-	return lib.GoConnectAuth(ctx, sshParams, c.ForceTerminal(), methods, secrets, logger)
+	tty := lib.WantTTY(c.ForceTerminal(), c.NoTerminal(), len(sshParams.Commands) > 0, logger)
+	native := clictx.Bool("native")
+	escape, err := lib.ParseEscapeChar(clictx.String("escape-char"))
+	if err != nil {
+		return err
+	}
+	mode := lib.SecretFile
+	if native {
+		mode = lib.SecretSetenv
+	}
+	if clictx.String("secret-mode") != "" {
+		mode, err = lib.ParseSecretMode(clictx.String("secret-mode"))
+		if err != nil {
+			return err
+		}
+	}
+	if len(clictx.StringSlice("option")) > 0 && !native {
+		return errors.New("--option can only be used with --native")
+	}
+	if native {
+		jumps, err := crypto.GetJumpCredentials(ctx, c, sshParams.ProxyJump, logger)
+		if err != nil {
+			return err
+		}
+		return lib.NativeConnect(
+			ctx, sshParams, tty, gparams.LogLevel == DEBUG, clictx.String("escape-char"), clictx.StringSlice("option"),
+			credentials, jumps, mode, secrets, logger,
+		)
+	}
+
+	methods := crypto.CredentialsToMethods(credentials, logger)
+	if len(methods) == 0 {
+		return errors.New("no usable credentials")
+	}
+
+	err = crypto.ResolveJumps(ctx, c, &sshParams, logger)
+	if err != nil {
+		return err
+	}
+
+	return lib.GoConnectAuth(ctx, sshParams, tty, mode, escape, methods, secrets, logger)
 }
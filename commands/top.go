@@ -2,12 +2,12 @@ package commands
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/remoteops"
 	"github.com/stephane-martin/vssh/sys"
@@ -15,7 +15,6 @@ import (
 
 	"github.com/gdamore/tcell"
 	"github.com/rivo/tview"
-	gssh "github.com/stephane-martin/golang-ssh"
 	"github.com/urfave/cli"
 	"golang.org/x/sync/errgroup"
 )
@@ -85,28 +84,12 @@ func topAction(clictx *cli.Context) (e error) {
 		return err
 	}
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 	if err != nil {
 		return err
 	}
-	methods := crypto.CredentialsToMethods(credentials, logger)
-	if len(methods) == 0 {
-		return errors.New("no usable credentials")
-	}
 
-	cfg := gssh.Config{
-		User:      sshParams.LoginName,
-		Host:      sshParams.Host,
-		Port:      sshParams.Port,
-		Auth:      methods,
-		HTTPProxy: sshParams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, sshParams, methods, logger)
 	if err != nil {
 		return err
 	}
@@ -8,10 +8,10 @@ import (
 	"strings"
 
 	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/sys"
 
-	gssh "github.com/stephane-martin/golang-ssh"
 	"github.com/urfave/cli"
 	"golang.org/x/sync/errgroup"
 )
@@ -95,28 +95,12 @@ func localTunnelAction(clictx *cli.Context) (e error) {
 		return err
 	}
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 	if err != nil {
 		return err
 	}
-	methods := crypto.CredentialsToMethods(credentials, logger)
-	if len(methods) == 0 {
-		return errors.New("no usable credentials")
-	}
 
-	cfg := gssh.Config{
-		User:      sshParams.LoginName,
-		Host:      sshParams.Host,
-		Port:      sshParams.Port,
-		Auth:      methods,
-		HTTPProxy: sshParams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, sshParams, methods, logger)
 	if err != nil {
 		return err
 	}
@@ -220,28 +204,12 @@ func remoteTunnelAction(clictx *cli.Context) (e error) {
 		return err
 	}
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 	if err != nil {
 		return err
 	}
-	methods := crypto.CredentialsToMethods(credentials, logger)
-	if len(methods) == 0 {
-		return errors.New("no usable credentials")
-	}
 
-	cfg := gssh.Config{
-		User:      sshParams.LoginName,
-		Host:      sshParams.Host,
-		Port:      sshParams.Port,
-		Auth:      methods,
-		HTTPProxy: sshParams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, sshParams, methods, logger)
 	if err != nil {
 		return err
 	}
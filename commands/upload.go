@@ -108,14 +108,10 @@ func wrapPut(f putFunc) cli.ActionFunc {
 			return err
 		}
 
-		_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+		methods, err := crypto.GetAuthMethods(ctx, c, &sshParams, logger)
 		if err != nil {
 			return err
 		}
-		methods := crypto.CredentialsToMethods(credentials, logger)
-		if len(methods) == 0 {
-			return errors.New("no usable credentials")
-		}
 
 		sourcesNames := filterOutEmptyStrings(clictx.StringSlice("source"))
 		if len(sourcesNames) == 0 {
@@ -0,0 +1,326 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+// CertCacheMargin is the minimum remaining validity of a cached certificate
+// for it to be reused. Certificates that expire sooner are signed again.
+const CertCacheMargin = 2 * time.Minute
+
+const certCacheDir = "~/.config/vssh/certs"
+const certCacheKeyFile = "~/.config/vssh/cache.key"
+const certCacheKeySize = 32
+
+// CertCache is an on-disk cache of certificates signed by Vault. The entries
+// are encrypted with AES-GCM, using a random key that is not stored with the
+// entries: it lives in the user runtime directory ($XDG_RUNTIME_DIR, a tmpfs
+// emptied at logout) when there is one, or else in ~/.config/vssh/cache.key.
+//
+// The encryption protects the copies of the cache directory, like backups. It
+// does not protect against someone who can read all the files of the user.
+type CertCache struct {
+	dir string
+	key *memguard.LockedBuffer
+}
+
+// CachedCertificate describes an entry of the certificates cache.
+type CachedCertificate struct {
+	Name        string    `json:"-"`
+	Fingerprint string    `json:"fingerprint"`
+	Principal   string    `json:"principal"`
+	Address     string    `json:"address"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Mount       string    `json:"mount"`
+	Role        string    `json:"role"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	Certificate string    `json:"certificate"`
+}
+
+// Expired returns true if the certificate should not be used anymore.
+func (c CachedCertificate) Expired() bool {
+	return !c.ValidBefore.IsZero() && time.Now().Add(CertCacheMargin).After(c.ValidBefore)
+}
+
+// NotYetValid returns true if the certificate can't be used yet.
+func (c CachedCertificate) NotYetValid() bool {
+	return !c.ValidAfter.IsZero() && time.Now().Before(c.ValidAfter)
+}
+
+// OpenCertCache opens the certificates cache, creating it if needed.
+func OpenCertCache() (*CertCache, error) {
+	dir, err := homedir.Expand(certCacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand cache directory path: %s", err)
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %s", err)
+	}
+	keyPath, err := cacheKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	key, err := readCacheKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &CertCache{dir: dir, key: key}, nil
+}
+
+// cacheKeyPath returns the path of the cache key, creating its directory if
+// needed.
+func cacheKeyPath() (string, error) {
+	if runtime := os.Getenv("XDG_RUNTIME_DIR"); runtime != "" {
+		if fi, err := os.Stat(runtime); err == nil && fi.IsDir() {
+			dir := filepath.Join(runtime, "vssh")
+			err := os.MkdirAll(dir, 0700)
+			if err != nil {
+				return "", fmt.Errorf("failed to create cache key directory: %s", err)
+			}
+			return filepath.Join(dir, "cache.key"), nil
+		}
+	}
+	p, err := homedir.Expand(certCacheKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand cache key path: %s", err)
+	}
+	return p, nil
+}
+
+func readCacheKey(path string) (*memguard.LockedBuffer, error) {
+	keyb, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(keyb) != certCacheKeySize {
+			memguard.WipeBytes(keyb)
+			return nil, errors.New("invalid cache key file")
+		}
+		return memguard.NewImmutableFromBytes(keyb)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read cache key: %s", err)
+	}
+	key, err := memguard.NewImmutableRandom(certCacheKeySize)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(path, key.Buffer())
+	if err != nil {
+		key.Destroy()
+		return nil, fmt.Errorf("failed to write cache key: %s", err)
+	}
+	return key, nil
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Close releases the cache encryption key.
+func (c *CertCache) Close() {
+	c.key.Destroy()
+}
+
+func entryName(pub *PublicKey, principal string, p params.VaultParams, options string) string {
+	h := sha256.New()
+	_, _ = h.Write(pub.Buffer())
+	fields := []string{
+		principal, vault.NormalizeAddress(p.Address), strings.Trim(p.Namespace, "/"), p.SSHMount, p.SSHRole, options,
+	}
+	for _, s := range fields {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(s))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *CertCache) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key.Buffer())
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Get returns the cached certificate for the given public key, principal,
+// Vault server, signer mount point, role and signing options. It returns nil
+// if there is no such certificate, if it expires soon or if it is not valid
+// yet.
+func (c *CertCache) Get(pub *PublicKey, principal string, p params.VaultParams, options string) (*memguard.LockedBuffer, error) {
+	entry, err := c.read(entryName(pub, principal, p, options))
+	if os.IsNotExist(err) || err == errUndecryptable {
+		// the entry was encrypted with a previous key
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry.Expired() || entry.NotYetValid() {
+		return nil, nil
+	}
+	return memguard.NewImmutableFromBytes([]byte(entry.Certificate))
+}
+
+// Put stores a signed certificate in the cache.
+func (c *CertCache) Put(pub *PublicKey, principal string, p params.VaultParams, options string, cert *memguard.LockedBuffer) error {
+	ce, err := gssh.ParseCertificate(cert.Buffer())
+	if err != nil {
+		return err
+	}
+	public, err := ssh.ParsePublicKey(pub.Buffer())
+	if err != nil {
+		return err
+	}
+	entry := CachedCertificate{
+		Fingerprint: ssh.FingerprintSHA256(public),
+		Principal:   principal,
+		Address:     p.Address,
+		Namespace:   p.Namespace,
+		Mount:       p.SSHMount,
+		Role:        p.SSHRole,
+		Certificate: string(cert.Buffer()),
+	}
+	if ce.ValidAfter != 0 {
+		entry.ValidAfter = time.Unix(int64(ce.ValidAfter), 0)
+	}
+	if ce.ValidBefore != ssh.CertTimeInfinity {
+		entry.ValidBefore = time.Unix(int64(ce.ValidBefore), 0)
+	}
+	plain, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	aead, err := c.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	return writeFileAtomic(filepath.Join(c.dir, entryName(pub, principal, p, options)), sealed)
+}
+
+var errUndecryptable = errors.New("failed to decrypt cache entry")
+
+func (c *CertCache) read(name string) (*CachedCertificate, error) {
+	sealed, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("truncated cache entry")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errUndecryptable
+	}
+	entry := new(CachedCertificate)
+	err = json.Unmarshal(plain, entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.Name = name
+	return entry, nil
+}
+
+func (c *CertCache) names() ([]string, error) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+// List returns the cached certificates. Unreadable entries are skipped.
+func (c *CertCache) List() ([]*CachedCertificate, error) {
+	names, err := c.names()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*CachedCertificate, 0, len(names))
+	for _, name := range names {
+		entry, err := c.read(name)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Purge removes the cached certificates. If expiredOnly is true, only the
+// expired and unreadable entries are removed. It returns the number of
+// removed entries.
+func (c *CertCache) Purge(expiredOnly bool) (int, error) {
+	names, err := c.names()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, name := range names {
+		if expiredOnly {
+			entry, err := c.read(name)
+			if err == nil && !entry.Expired() {
+				continue
+			}
+		}
+		err := os.Remove(filepath.Join(c.dir, name))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedCertificateValidity(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		validAfter  time.Time
+		validBefore time.Time
+		expired     bool
+		notYetValid bool
+	}{
+		{name: "valid", validAfter: now.Add(-time.Hour), validBefore: now.Add(time.Hour)},
+		{name: "forever"},
+		{name: "expired", validAfter: now.Add(-time.Hour), validBefore: now.Add(-time.Minute), expired: true},
+		{name: "expires soon", validBefore: now.Add(CertCacheMargin / 2), expired: true},
+		{name: "in the future", validAfter: now.Add(time.Minute), validBefore: now.Add(time.Hour), notYetValid: true},
+	}
+	for _, test := range tests {
+		c := CachedCertificate{ValidAfter: test.validAfter, ValidBefore: test.validBefore}
+		if c.Expired() != test.expired || c.NotYetValid() != test.notYetValid {
+			t.Errorf("%s: Expired = %v, NotYetValid = %v", test.name, c.Expired(), c.NotYetValid())
+		}
+	}
+}
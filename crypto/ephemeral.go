@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// GenerateEphemeralKey generates a new ed25519 private key. The private key is
+// returned in the OpenSSH format, and only lives in memguard memory.
+func GenerateEphemeralKey() (*memguard.LockedBuffer, *PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer memguard.WipeBytes(priv)
+	public, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var check [4]byte
+	_, err = rand.Read(check[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	pk1 := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{
+		Check1:  binary.BigEndian.Uint32(check[:]),
+		Check2:  binary.BigEndian.Uint32(check[:]),
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     pub,
+		Priv:    priv,
+		Comment: "vssh ephemeral key",
+	}
+	// the private section is padded to the cipher block size (8 for "none").
+	// The padding is the rest of the section, so it is appended to the
+	// marshaled section.
+	privBlock := ssh.Marshal(pk1)
+	defer func() { memguard.WipeBytes(privBlock) }()
+	if rem := len(privBlock) % 8; rem != 0 {
+		padded := make([]byte, len(privBlock), len(privBlock)+8-rem)
+		copy(padded, privBlock)
+		memguard.WipeBytes(privBlock)
+		privBlock = padded
+		for i := 1; i <= 8-rem; i++ {
+			privBlock = append(privBlock, byte(i))
+		}
+	}
+
+	w := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       public.Marshal(),
+		PrivKeyBlock: privBlock,
+	}
+	body := ssh.Marshal(w)
+	defer memguard.WipeBytes(body)
+	der := append([]byte(opensshMagic), body...)
+	defer memguard.WipeBytes(der)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: opensshPEMType, Bytes: der})
+	privkey, err := memguard.NewImmutableFromBytes(pemBytes)
+	if err != nil {
+		memguard.WipeBytes(pemBytes)
+		return nil, nil, err
+	}
+
+	pubBytes := public.Marshal()
+	pubBuf, err := memguard.NewImmutableFromBytes(pubBytes)
+	if err != nil {
+		privkey.Destroy()
+		memguard.WipeBytes(pubBytes)
+		return nil, nil, err
+	}
+	return privkey, (*PublicKey)(pubBuf), nil
+}
@@ -0,0 +1,32 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateEphemeralKey(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		privkey, pubkey, err := GenerateEphemeralKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ParsePrivateKey checks the checksums and the padding
+		signer, err := ssh.ParsePrivateKey(privkey.Buffer())
+		if err != nil {
+			t.Fatalf("the ephemeral key can't be parsed: %s", err)
+		}
+		if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+			t.Errorf("got a %s key", signer.PublicKey().Type())
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), pubkey.Buffer()) {
+			t.Error("the public key does not match the private key")
+		}
+		needPass, err := NeedPassphrase(privkey)
+		if err != nil || needPass {
+			t.Errorf("NeedPassphrase = %v, %v", needPass, err)
+		}
+	}
+}
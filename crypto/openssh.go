@@ -0,0 +1,331 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/awnumar/memguard"
+	"github.com/dchest/bcrypt_pbkdf"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const opensshMagic = "openssh-key-v1\x00"
+const opensshPEMType = "OPENSSH PRIVATE KEY"
+
+// opensshKey is the envelope of the openssh-key-v1 private key format, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+type opensshKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+	// the authentication tag of the AEAD ciphers follows the private block
+	Rest []byte `ssh:"rest"`
+}
+
+type opensshCipher struct {
+	keyLen    int
+	ivLen     int
+	blockSize int
+	tagLen    int
+	decrypt   func(key, iv, dst, src, tag []byte) error
+}
+
+var opensshCiphers = map[string]opensshCipher{
+	"aes128-ctr":             {keyLen: 16, ivLen: aes.BlockSize, blockSize: aes.BlockSize, decrypt: decryptCTR},
+	"aes192-ctr":             {keyLen: 24, ivLen: aes.BlockSize, blockSize: aes.BlockSize, decrypt: decryptCTR},
+	"aes256-ctr":             {keyLen: 32, ivLen: aes.BlockSize, blockSize: aes.BlockSize, decrypt: decryptCTR},
+	"aes128-cbc":             {keyLen: 16, ivLen: aes.BlockSize, blockSize: aes.BlockSize, decrypt: decryptCBC},
+	"aes192-cbc":             {keyLen: 24, ivLen: aes.BlockSize, blockSize: aes.BlockSize, decrypt: decryptCBC},
+	"aes256-cbc":             {keyLen: 32, ivLen: aes.BlockSize, blockSize: aes.BlockSize, decrypt: decryptCBC},
+	"aes128-gcm@openssh.com": {keyLen: 16, ivLen: 12, blockSize: aes.BlockSize, tagLen: 16, decrypt: decryptGCM},
+	"aes256-gcm@openssh.com": {keyLen: 32, ivLen: 12, blockSize: aes.BlockSize, tagLen: 16, decrypt: decryptGCM},
+}
+
+func decryptCTR(key, iv, dst, src, tag []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(dst, src)
+	return nil
+}
+
+func decryptCBC(key, iv, dst, src, tag []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(dst, src)
+	return nil
+}
+
+func decryptGCM(key, iv, dst, src, tag []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, 0, len(src)+len(tag))
+	sealed = append(append(sealed, src...), tag...)
+	_, err = aead.Open(dst[:0], iv, sealed, nil)
+	if err != nil {
+		return errors.New("wrong passphrase")
+	}
+	return nil
+}
+
+func parseOpenSSHKey(der []byte) (*opensshKey, error) {
+	if len(der) < len(opensshMagic) || string(der[:len(opensshMagic)]) != opensshMagic {
+		return nil, errors.New("invalid openssh private key format")
+	}
+	k := new(opensshKey)
+	err := ssh.Unmarshal(der[len(opensshMagic):], k)
+	if err != nil {
+		return nil, fmt.Errorf("invalid openssh private key: %s", err)
+	}
+	if k.NumKeys != 1 {
+		return nil, errors.New("openssh private key files with several keys are not supported")
+	}
+	return k, nil
+}
+
+// opensshEncrypted tells if the openssh-key-v1 private key is encrypted.
+func opensshEncrypted(der []byte) (bool, error) {
+	k, err := parseOpenSSHKey(der)
+	if err != nil {
+		return false, err
+	}
+	return k.CipherName != "none", nil
+}
+
+// decryptOpenSSHKey decrypts an openssh-key-v1 private key, and returns it
+// unencrypted, in the same PEM format.
+func decryptOpenSSHKey(der []byte, pass *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	k, err := parseOpenSSHKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if k.KdfName != "bcrypt" {
+		return nil, fmt.Errorf("unsupported openssh private key KDF: %s", k.KdfName)
+	}
+	c, ok := opensshCiphers[k.CipherName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported openssh private key cipher: %s", k.CipherName)
+	}
+	var opts struct {
+		Salt   []byte
+		Rounds uint32
+	}
+	err = ssh.Unmarshal([]byte(k.KdfOpts), &opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid openssh private key KDF options: %s", err)
+	}
+	if len(k.PrivKeyBlock) == 0 || len(k.PrivKeyBlock)%c.blockSize != 0 {
+		return nil, errors.New("invalid openssh private key: bad private section length")
+	}
+	if len(k.Rest) < c.tagLen {
+		return nil, errors.New("invalid openssh private key: missing authentication tag")
+	}
+	if len(pass.Buffer()) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+
+	keyIV, err := bcrypt_pbkdf.Key(pass.Buffer(), opts.Salt, int(opts.Rounds), c.keyLen+c.ivLen)
+	if err != nil {
+		return nil, err
+	}
+	keyIVBuf, err := memguard.NewImmutableFromBytes(keyIV)
+	if err != nil {
+		memguard.WipeBytes(keyIV)
+		return nil, err
+	}
+	defer keyIVBuf.Destroy()
+
+	privBlock, err := memguard.NewMutable(len(k.PrivKeyBlock))
+	if err != nil {
+		return nil, err
+	}
+	defer privBlock.Destroy()
+	key := keyIVBuf.Buffer()[:c.keyLen]
+	iv := keyIVBuf.Buffer()[c.keyLen:]
+	err = c.decrypt(key, iv, privBlock.Buffer(), k.PrivKeyBlock, k.Rest[:c.tagLen])
+	if err != nil {
+		return nil, err
+	}
+	// with the ciphers that are not authenticated, the check integers tell if
+	// the passphrase was right
+	plain := privBlock.Buffer()
+	if len(plain) < 8 || binary.BigEndian.Uint32(plain[:4]) != binary.BigEndian.Uint32(plain[4:8]) {
+		return nil, errors.New("wrong passphrase")
+	}
+
+	w := opensshKey{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       k.PubKey,
+		PrivKeyBlock: plain,
+	}
+	body := ssh.Marshal(w)
+	defer memguard.WipeBytes(body)
+	decrypted := append([]byte(opensshMagic), body...)
+	defer memguard.WipeBytes(decrypted)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: opensshPEMType, Bytes: decrypted})
+	privkey, err := memguard.NewImmutableFromBytes(pemBytes)
+	if err != nil {
+		memguard.WipeBytes(pemBytes)
+		return nil, err
+	}
+	return privkey, nil
+}
+
+// parseOpenSSHRawKey parses an unencrypted openssh-key-v1 private key. Unlike
+// golang.org/x/crypto/ssh, it handles the ECDSA keys, and it does not copy
+// der, so that wiping der wipes the serialized key.
+func parseOpenSSHRawKey(der []byte) (interface{}, error) {
+	k, err := parseOpenSSHKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if k.CipherName != "none" {
+		return nil, errors.New("the private key is encrypted")
+	}
+	var pk1 struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Rest    []byte `ssh:"rest"`
+	}
+	err = ssh.Unmarshal(k.PrivKeyBlock, &pk1)
+	if err != nil {
+		return nil, err
+	}
+	if pk1.Check1 != pk1.Check2 {
+		return nil, errors.New("invalid openssh private key: checkint mismatch")
+	}
+	switch pk1.Keytype {
+	case ssh.KeyAlgoRSA:
+		var key struct {
+			N       *big.Int
+			E       *big.Int
+			D       *big.Int
+			Iqmp    *big.Int
+			P       *big.Int
+			Q       *big.Int
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		err = ssh.Unmarshal(pk1.Rest, &key)
+		if err != nil {
+			return nil, err
+		}
+		wipeBigInt(key.Iqmp)
+		pk := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: key.N, E: int(key.E.Int64())},
+			D:         key.D,
+			Primes:    []*big.Int{key.P, key.Q},
+		}
+		err = pk.Validate()
+		if err != nil {
+			wipeRawPrivateKey(pk)
+			return nil, err
+		}
+		pk.Precompute()
+		return pk, nil
+	case ssh.KeyAlgoED25519:
+		var key struct {
+			Pub     []byte
+			Priv    []byte
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		err = ssh.Unmarshal(pk1.Rest, &key)
+		if err != nil {
+			return nil, err
+		}
+		if len(key.Priv) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid ed25519 private key length")
+		}
+		pk := ed25519.PrivateKey(make([]byte, ed25519.PrivateKeySize))
+		copy(pk, key.Priv)
+		return &pk, nil
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		curve := map[string]elliptic.Curve{
+			ssh.KeyAlgoECDSA256: elliptic.P256(),
+			ssh.KeyAlgoECDSA384: elliptic.P384(),
+			ssh.KeyAlgoECDSA521: elliptic.P521(),
+		}[pk1.Keytype]
+		var key struct {
+			Curve   string
+			Pub     []byte
+			D       *big.Int
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		err = ssh.Unmarshal(pk1.Rest, &key)
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.Unmarshal(curve, key.Pub)
+		if x == nil {
+			wipeBigInt(key.D)
+			return nil, errors.New("invalid ECDSA public key")
+		}
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         key.D,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported openssh private key type: %s", pk1.Keytype)
+	}
+}
+
+// convertOpenSSHECDSA converts an unencrypted openssh-key-v1 ECDSA private key
+// to the SEC 1 PEM format, as golang.org/x/crypto/ssh only parses the RSA and
+// ed25519 keys in the openssh-key-v1 format. The other keys are returned
+// unchanged.
+func convertOpenSSHECDSA(privkey *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	block, _ := pem.Decode(privkey.Buffer())
+	if block == nil || block.Type != opensshPEMType {
+		return privkey, nil
+	}
+	defer memguard.WipeBytes(block.Bytes)
+	raw, err := parseOpenSSHRawKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeRawPrivateKey(raw)
+	ecKey, ok := raw.(*ecdsa.PrivateKey)
+	if !ok {
+		return privkey, nil
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return nil, err
+	}
+	defer memguard.WipeBytes(der)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	converted, err := memguard.NewImmutableFromBytes(pemBytes)
+	if err != nil {
+		memguard.WipeBytes(pemBytes)
+		return nil, err
+	}
+	privkey.Destroy()
+	return converted, nil
+}
@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ssh"
+)
+
+// The fixtures of testdata were generated with ssh-keygen: NAME is the
+// unencrypted key, NAME-CIPHER is the same key encrypted with the passphrase
+// "passphrase", with ssh-keygen -p -N passphrase -Z CIPHER -a 4.
+
+const fixturePassphrase = "passphrase"
+
+var opensshFixtures = []struct {
+	key    string
+	cipher string
+}{
+	{"rsa", "aes256-ctr"},
+	{"rsa", "aes256-cbc"},
+	{"rsa", "aes256-gcm@openssh.com"},
+	{"ecdsa-256", "aes256-ctr"},
+	{"ecdsa-256", "aes256-cbc"},
+	{"ecdsa-256", "aes256-gcm@openssh.com"},
+	{"ecdsa-384", "aes256-ctr"},
+	{"ecdsa-384", "aes256-cbc"},
+	{"ecdsa-384", "aes256-gcm@openssh.com"},
+	{"ecdsa-521", "aes256-ctr"},
+	{"ecdsa-521", "aes256-cbc"},
+	{"ecdsa-521", "aes256-gcm@openssh.com"},
+	{"ed25519", "aes128-ctr"},
+	{"ed25519", "aes192-ctr"},
+	{"ed25519", "aes256-ctr"},
+	{"ed25519", "aes128-cbc"},
+	{"ed25519", "aes192-cbc"},
+	{"ed25519", "aes256-cbc"},
+	{"ed25519", "aes128-gcm@openssh.com"},
+	{"ed25519", "aes256-gcm@openssh.com"},
+}
+
+func fixturePath(key, cipher string) string {
+	if cipher == "" {
+		return filepath.Join("testdata", key)
+	}
+	return filepath.Join("testdata", key+"-"+strings.TrimSuffix(cipher, "@openssh.com"))
+}
+
+func readFixture(t *testing.T, path string) *memguard.LockedBuffer {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := memguard.NewImmutableFromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func passphrase(t *testing.T, s string) *memguard.LockedBuffer {
+	t.Helper()
+	pass, err := memguard.NewImmutableFromBytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pass
+}
+
+// checkPublicKey checks that privkey is the private key of the fixture, and
+// that golang.org/x/crypto/ssh can use it.
+func checkPublicKey(t *testing.T, name string, key string, privkey *memguard.LockedBuffer) {
+	t.Helper()
+	if _, err := ssh.ParsePrivateKey(privkey.Buffer()); err != nil {
+		t.Errorf("%s: the private key can't be parsed: %s", name, err)
+		return
+	}
+	public, err := DerivePublicKey(privkey)
+	if err != nil {
+		t.Errorf("%s: failed to derive the public key: %s", name, err)
+		return
+	}
+	serialized, err := SerializePublicKey(public)
+	if err != nil {
+		t.Errorf("%s: failed to serialize the public key: %s", name, err)
+		return
+	}
+	want, err := ioutil.ReadFile(fixturePath(key, "") + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serialized.Buffer(); !bytes.Equal(got, bytes.TrimSpace(want)) {
+		t.Errorf("%s: got public key %s, want %s", name, got, bytes.TrimSpace(want))
+	}
+}
+
+func TestDecryptOpenSSHKey(t *testing.T) {
+	for _, fixture := range opensshFixtures {
+		path := fixturePath(fixture.key, fixture.cipher)
+		privkey := readFixture(t, path)
+
+		block, _ := pem.Decode(privkey.Buffer())
+		if block == nil || block.Type != opensshPEMType {
+			t.Fatalf("%s: not an openssh-key-v1 private key", path)
+		}
+		k, err := parseOpenSSHKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if k.CipherName != fixture.cipher {
+			t.Fatalf("%s: the fixture is encrypted with %s", path, k.CipherName)
+		}
+
+		needPass, err := NeedPassphrase(privkey)
+		if err != nil || !needPass {
+			t.Errorf("%s: NeedPassphrase = %v, %v", path, needPass, err)
+		}
+		decrypted, err := DecryptPrivateKey(privkey, passphrase(t, fixturePassphrase))
+		if err != nil {
+			t.Errorf("%s: failed to decrypt: %s", path, err)
+			continue
+		}
+		needPass, err = NeedPassphrase(decrypted)
+		if err != nil || needPass {
+			t.Errorf("%s: the decrypted key still needs a passphrase: %v, %v", path, needPass, err)
+		}
+		converted, err := convertOpenSSHECDSA(decrypted)
+		if err != nil {
+			t.Errorf("%s: failed to convert: %s", path, err)
+			continue
+		}
+		checkPublicKey(t, path, fixture.key, converted)
+	}
+}
+
+func TestDecryptOpenSSHKeyWrongPassphrase(t *testing.T) {
+	for _, fixture := range opensshFixtures {
+		path := fixturePath(fixture.key, fixture.cipher)
+		_, err := DecryptPrivateKey(readFixture(t, path), passphrase(t, "wrong"))
+		if err == nil {
+			t.Errorf("%s: decrypted with a wrong passphrase", path)
+		}
+	}
+}
+
+func TestConvertOpenSSHECDSA(t *testing.T) {
+	for _, key := range []string{"rsa", "ecdsa-256", "ecdsa-384", "ecdsa-521", "ed25519"} {
+		path := fixturePath(key, "")
+		privkey := readFixture(t, path)
+		needPass, err := NeedPassphrase(privkey)
+		if err != nil || needPass {
+			t.Errorf("%s: NeedPassphrase = %v, %v", path, needPass, err)
+		}
+		converted, err := convertOpenSSHECDSA(privkey)
+		if err != nil {
+			t.Errorf("%s: failed to convert: %s", path, err)
+			continue
+		}
+		block, _ := pem.Decode(converted.Buffer())
+		wantType := opensshPEMType
+		if strings.HasPrefix(key, "ecdsa") {
+			wantType = "EC PRIVATE KEY"
+		}
+		if block == nil || block.Type != wantType {
+			t.Errorf("%s: converted to a PEM block of the wrong type", path)
+			continue
+		}
+		checkPublicKey(t, path, key, converted)
+	}
+}
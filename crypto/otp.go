@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+
+	"github.com/awnumar/memguard"
+	"github.com/hashicorp/vault/api"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+)
+
+// OTP asks the Vault SSH secrets engine in OTP mode for a one-time password
+// to connect to the host at ip.
+func OTP(ctx context.Context, ip, login, sshMount, sshRole string, clt *api.Client, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
+	defer runtime.GC()
+	r := clt.NewRequest("PUT", fmt.Sprintf("/v1/%s/creds/%s", sshMount, sshRole))
+	err := r.SetJSONBody(map[string]interface{}{
+		"ip":       ip,
+		"username": login,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := clt.RawRequestWithContext(ctx, r)
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := memguard.NewImmutableFromBytes(b)
+	if err != nil {
+		memguard.WipeBytes(b)
+		return nil, err
+	}
+	defer respBody.Destroy()
+	p := new(fastjson.Parser)
+	val, err := p.ParseBytes(respBody.Buffer())
+	p = nil
+	if err != nil {
+		return nil, err
+	}
+	if keyType := string(val.GetStringBytes("data", "key_type")); keyType != "" && keyType != "otp" {
+		return nil, fmt.Errorf("the Vault role is not in OTP mode: %s", keyType)
+	}
+	s := val.GetStringBytes("data", "key")
+	if len(s) == 0 {
+		errStr := string(val.GetStringBytes("errors", "0"))
+		if errStr != "" {
+			return nil, errors.New(errStr)
+		}
+		// do not log the response, it may contain the OTP
+		return nil, errors.New("unexpected Vault response")
+	}
+	val = nil
+	otp, err := memguard.NewImmutableFromBytes(s)
+	if err != nil {
+		memguard.WipeBytes(s)
+		return nil, err
+	}
+	return otp, nil
+}
+
+// resolveIP returns the IP address of host, preferring IPv4.
+func resolveIP(ctx context.Context, host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no address for %s", host)
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String(), nil
+		}
+	}
+	return addrs[0].IP.String(), nil
+}
+
+// getOTPCredentials asks Vault for a one-time password for the target host.
+func getOTPCredentials(ctx context.Context, host, loginName string, vaultClient *lazyVaultClient, l *zap.SugaredLogger) ([]SSHCredentials, error) {
+	if idx := strings.LastIndex(host, "@"); idx != -1 {
+		host = host[idx+1:]
+	}
+	if host == "" {
+		return nil, errors.New("OTP mode needs the target host")
+	}
+	ip, err := resolveIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %s", host, err)
+	}
+	client, err := vaultClient.get(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.New("OTP mode needs Vault")
+	}
+	otp, err := OTP(ctx, ip, loginName, vaultClient.params.SSHMount, vaultClient.params.SSHRole, client, l)
+	if err == context.Canceled {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get OTP from vault: %s", err)
+	}
+	l.Infow("enabled: one-time password from vault", "ip", ip)
+	return []SSHCredentials{{Password: otp}}, nil
+}
@@ -28,7 +28,10 @@ func NeedPassphrase(privkey *memguard.LockedBuffer) (bool, error) {
 	if block == nil {
 		return false, errors.New("failed to PEM-decode the private key")
 	}
-	memguard.WipeBytes(block.Bytes)
+	defer memguard.WipeBytes(block.Bytes)
+	if block.Type == opensshPEMType {
+		return opensshEncrypted(block.Bytes)
+	}
 	return strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"), nil
 }
 
@@ -38,6 +41,17 @@ func DecryptPrivateKey(privkey, pass *memguard.LockedBuffer) (*memguard.LockedBu
 	if block == nil {
 		return nil, errors.New("failed to PEM-decode the private key")
 	}
+	if block.Type == opensshPEMType {
+		defer memguard.WipeBytes(block.Bytes)
+		encrypted, err := opensshEncrypted(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if !encrypted {
+			return privkey, nil
+		}
+		return decryptOpenSSHKey(block.Bytes, pass)
+	}
 	if x509.IsEncryptedPEMBlock(block) {
 		typ := block.Type
 		der, err := x509.DecryptPEMBlock(block, pass.Buffer())
@@ -76,11 +90,11 @@ func (k *PublicKey) MarshalJSON() ([]byte, error) {
 
 func DerivePublicKey(privkey *memguard.LockedBuffer) (*PublicKey, error) {
 	// newpublickey: *dsa.PrivateKey, *ecdsa.PublicKey, *dsa.PublicKey, ed25519.PublicKey
-	// TODO: the private key content leaks in p. wipe it.
 	p, err := ssh.ParseRawPrivateKey(privkey.Buffer())
 	if err != nil {
 		return nil, err
 	}
+	defer wipeRawPrivateKey(p)
 	var public ssh.PublicKey
 	switch pk := p.(type) {
 	case *dsa.PrivateKey:
@@ -162,23 +176,32 @@ func ReadPrivateKeyFromFileSystem(path string) (*memguard.LockedBuffer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create memguard for private key: %s", err)
 	}
+	return UnlockPrivateKey(privkey, "Enter the passphrase for the private key")
+}
+
+// UnlockPrivateKey asks for the passphrase of the private key and decrypts it,
+// if the private key is encrypted.
+func UnlockPrivateKey(privkey *memguard.LockedBuffer, prompt string) (*memguard.LockedBuffer, error) {
 	needPass, err := NeedPassphrase(privkey)
 	if err != nil {
+		privkey.Destroy()
 		return nil, fmt.Errorf("error parsing private key: %s", err)
 	}
-	if needPass {
-		pass, err := InputPassword("Enter the passphrase for the private key")
-		if err != nil {
-			return nil, fmt.Errorf("failed to get passphrase: %s", err)
-		}
-		decrypted, err := DecryptPrivateKey(privkey, pass)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt private key: %s", err)
-		}
+	if !needPass {
+		return convertOpenSSHECDSA(privkey)
+	}
+	pass, err := InputPassword(prompt)
+	if err != nil {
 		privkey.Destroy()
-		privkey = decrypted
+		return nil, fmt.Errorf("failed to get passphrase: %s", err)
 	}
-	return privkey, nil
+	decrypted, err := DecryptPrivateKey(privkey, pass)
+	pass.Destroy()
+	privkey.Destroy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %s", err)
+	}
+	return convertOpenSSHECDSA(decrypted)
 }
 
 func InputPassword(prompt string) (*memguard.LockedBuffer, error) {
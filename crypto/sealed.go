@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// SealedSigner is a ssh.Signer whose private key is kept encrypted, under a
+// random key that stays in memguard memory. The private key is decrypted and
+// parsed only inside Sign, and wiped right after the signature.
+type SealedSigner struct {
+	key    *memguard.LockedBuffer
+	nonce  []byte
+	sealed []byte
+	public ssh.PublicKey
+}
+
+// NewSealedSigner returns a signer for the given private key. The signer keeps
+// its own encrypted copy of the private key.
+func NewSealedSigner(privkey *memguard.LockedBuffer) (*SealedSigner, error) {
+	if privkey == nil || privkey.IsDestroyed() {
+		return nil, errors.New("no private key")
+	}
+	pub, err := DerivePublicKey(privkey)
+	if err != nil {
+		return nil, err
+	}
+	// the parsed public key may reference its input, so it must not be
+	// parsed from the memguard buffer
+	pubBytes := append([]byte(nil), pub.Buffer()...)
+	(*memguard.LockedBuffer)(pub).Destroy()
+	public, err := ssh.ParsePublicKey(pubBytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := memguard.NewImmutableRandom(32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	return &SealedSigner{
+		key:    key,
+		nonce:  nonce,
+		sealed: aead.Seal(nil, nonce, privkey.Buffer(), nil),
+		public: public,
+	}, nil
+}
+
+func newAEAD(key *memguard.LockedBuffer) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Buffer())
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PublicKey implements ssh.Signer.
+func (s *SealedSigner) PublicKey() ssh.PublicKey {
+	return s.public
+}
+
+// Destroy destroys the encryption key: the signer can't be used anymore.
+func (s *SealedSigner) Destroy() {
+	s.key.Destroy()
+}
+
+// Sign implements ssh.Signer.
+func (s *SealedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+// SignWithAlgorithm implements ssh.AlgorithmSigner.
+func (s *SealedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	raw, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer wipeRawPrivateKey(raw)
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == "" {
+		return signer.Sign(rand, data)
+	}
+	algoSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("signature does not support non-default signature algorithm: %T", signer)
+	}
+	return algoSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// open decrypts the private key in memguard memory, and parses it. The caller
+// must wipe the parsed key with wipeRawPrivateKey.
+func (s *SealedSigner) open() (interface{}, error) {
+	if s.key.IsDestroyed() {
+		return nil, errors.New("the private key has been destroyed")
+	}
+	aead, err := newAEAD(s.key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := memguard.NewMutable(len(s.sealed) - aead.Overhead())
+	if err != nil {
+		return nil, err
+	}
+	defer plain.Destroy()
+	_, err = aead.Open(plain.Buffer()[:0], s.nonce, s.sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(plain.Buffer())
+	if block == nil {
+		return nil, errors.New("no PEM block in private key")
+	}
+	defer memguard.WipeBytes(block.Bytes)
+	return parseRawPrivateKey(block)
+}
+
+// parseRawPrivateKey parses the DER of a PEM private key, like
+// ssh.ParseRawPrivateKey, without copying the DER.
+func parseRawPrivateKey(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "DSA PRIVATE KEY":
+		return ssh.ParseDSAPrivateKey(block.Bytes)
+	case opensshPEMType:
+		return parseOpenSSHRawKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", block.Type)
+	}
+}
+
+func wipeBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
+
+// wipeRawPrivateKey overwrites the secret parts of a parsed private key.
+func wipeRawPrivateKey(raw interface{}) {
+	switch k := raw.(type) {
+	case *rsa.PrivateKey:
+		wipeBigInt(k.D)
+		for _, p := range k.Primes {
+			wipeBigInt(p)
+		}
+		wipeBigInt(k.Precomputed.Dp)
+		wipeBigInt(k.Precomputed.Dq)
+		wipeBigInt(k.Precomputed.Qinv)
+		for _, v := range k.Precomputed.CRTValues {
+			wipeBigInt(v.Exp)
+			wipeBigInt(v.Coeff)
+			wipeBigInt(v.R)
+		}
+	case *ecdsa.PrivateKey:
+		wipeBigInt(k.D)
+	case *dsa.PrivateKey:
+		wipeBigInt(k.X)
+	case *ed25519.PrivateKey:
+		memguard.WipeBytes(*k)
+	case ed25519.PrivateKey:
+		memguard.WipeBytes(k)
+	case stded25519.PrivateKey:
+		memguard.WipeBytes(k)
+	}
+}
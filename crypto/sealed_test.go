@@ -0,0 +1,150 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSealedSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(pkcs8Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]*memguard.LockedBuffer{
+		"pkcs1 rsa": pemBuffer(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+		"ec":        pemBuffer(t, "EC PRIVATE KEY", ecDER),
+		"pkcs8":     pemBuffer(t, "PRIVATE KEY", pkcs8DER),
+	}
+	for _, name := range []string{"rsa", "ecdsa-256", "ecdsa-384", "ecdsa-521", "ed25519"} {
+		// like the keys read by vssh, the openssh ECDSA keys are converted
+		converted, err := convertOpenSSHECDSA(readFixture(t, fixturePath(name, "")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys["openssh "+name] = converted
+	}
+
+	data := []byte("data to sign")
+	for name, privkey := range keys {
+		parsed, err := ssh.ParsePrivateKey(privkey.Buffer())
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		signer, err := NewSealedSigner(privkey)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if bytes.Contains(signer.sealed, privkey.Buffer()[40:80]) {
+			t.Errorf("%s: the private key is not encrypted", name)
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), parsed.PublicKey().Marshal()) {
+			t.Errorf("%s: the public key does not match the private key", name)
+		}
+		// the signer has its own copy of the private key
+		privkey.Destroy()
+		sig, err := signer.Sign(rand.Reader, data)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if err := signer.PublicKey().Verify(data, sig); err != nil {
+			t.Errorf("%s: invalid signature: %s", name, err)
+		}
+		if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			sig, err := signer.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2256)
+			if err != nil || sig.Format != ssh.SigAlgoRSASHA2256 {
+				t.Errorf("%s: SignWithAlgorithm: %v, %v", name, sig, err)
+			} else if err := signer.PublicKey().Verify(data, sig); err != nil {
+				t.Errorf("%s: invalid signature: %s", name, err)
+			}
+		}
+		signer.Destroy()
+		if _, err := signer.Sign(rand.Reader, data); err == nil {
+			t.Errorf("%s: signed with a destroyed signer", name)
+		}
+	}
+}
+
+func TestSealedSignerErrors(t *testing.T) {
+	if _, err := NewSealedSigner(nil); err == nil {
+		t.Error("nil key: expected an error")
+	}
+	destroyed := readFixture(t, fixturePath("ed25519", ""))
+	destroyed.Destroy()
+	if _, err := NewSealedSigner(destroyed); err == nil {
+		t.Error("destroyed key: expected an error")
+	}
+	if _, err := NewSealedSigner(pemBuffer(t, "RSA PRIVATE KEY", []byte("garbage"))); err == nil {
+		t.Error("invalid key: expected an error")
+	}
+	if _, err := parseRawPrivateKey(&pem.Block{Type: "OTHER PRIVATE KEY"}); err == nil {
+		t.Error("unsupported key type: expected an error")
+	}
+}
+
+func TestWipeRawPrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey.Precompute()
+	wipeRawPrivateKey(rsaKey)
+	for _, n := range append([]*big.Int{rsaKey.D, rsaKey.Precomputed.Dp, rsaKey.Precomputed.Dq, rsaKey.Precomputed.Qinv}, rsaKey.Primes...) {
+		if n.Sign() != 0 {
+			t.Error("the RSA private key is not wiped")
+		}
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wipeRawPrivateKey(ecKey)
+	if ecKey.D.Sign() != 0 {
+		t.Error("the ECDSA private key is not wiped")
+	}
+	raw, err := ssh.ParseRawPrivateKey(readFixture(t, fixturePath("ed25519", "")).Buffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wipeRawPrivateKey(raw)
+	if key := *raw.(*ed25519.PrivateKey); !bytes.Equal(key, make([]byte, len(key))) {
+		t.Error("the ed25519 private key is not wiped")
+	}
+}
+
+func pemBuffer(t *testing.T, pemType string, der []byte) *memguard.LockedBuffer {
+	t.Helper()
+	buf, err := memguard.NewImmutableFromBytes(pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
@@ -1,33 +1,108 @@
 package crypto
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/awnumar/memguard"
-	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/vault/api"
-	"github.com/hashicorp/vault/helper/consts"
 	"github.com/valyala/fastjson"
 )
 
-func Sign(ctx context.Context, pub *PublicKey, login, sshMount, sshRole string, clt *api.Client, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
+// SignOptions are the optional parameters of a signing request. The zero
+// value uses the defaults of the Vault role.
+type SignOptions struct {
+	TTL             time.Duration
+	Principals      []string
+	Extensions      map[string]string
+	CriticalOptions map[string]string
+	KeyID           string
+}
+
+// String returns a canonical representation of the options.
+func (o SignOptions) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ttl=%d;key_id=%q;principals=%q", int64(o.TTL/time.Second), o.KeyID, o.Principals)
+	for _, m := range []map[string]string{o.Extensions, o.CriticalOptions} {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString(";")
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%q=%q,", k, m[k])
+		}
+	}
+	return b.String()
+}
+
+// AuthError is returned by Sign when Vault rejects the token, for instance
+// because it has expired.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func parseKeyValues(values []string, needValue bool) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		idx := strings.Index(v, "=")
+		if idx == -1 {
+			if needValue {
+				return nil, fmt.Errorf("missing value in '%s', use name=value", v)
+			}
+			m[v] = ""
+			continue
+		}
+		name := strings.TrimSpace(v[:idx])
+		if name == "" {
+			return nil, fmt.Errorf("missing name in '%s', use name=value", v)
+		}
+		m[name] = strings.TrimSpace(v[idx+1:])
+	}
+	return m, nil
+}
+
+func Sign(ctx context.Context, pub *PublicKey, login, sshMount, sshRole string, opts SignOptions, clt *api.Client, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
 	defer runtime.GC()
+	principals := append([]string{login}, opts.Principals...)
 	data := map[string]interface{}{
-		"valid_principals": login,
+		"valid_principals": strings.Join(principals, ","),
 		"public_key":       pub,
 		"cert_type":        "user",
 	}
+	if opts.TTL > 0 {
+		data["ttl"] = fmt.Sprintf("%ds", int64(opts.TTL/time.Second))
+	}
+	if len(opts.Extensions) > 0 {
+		data["extensions"] = opts.Extensions
+	}
+	if len(opts.CriticalOptions) > 0 {
+		data["critical_options"] = opts.CriticalOptions
+	}
+	if opts.KeyID != "" {
+		data["key_id"] = opts.KeyID
+	}
 	buf, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
@@ -38,24 +113,18 @@ func Sign(ctx context.Context, pub *PublicKey, login, sshMount, sshRole string,
 		return nil, err
 	}
 	defer reqBody.Destroy()
-	u, err := url.Parse(clt.Address())
-	if err != nil {
-		return nil, err
-	}
-	u.Path = fmt.Sprintf("/v1/%s/sign/%s", sshMount, sshRole)
-	r := &http.Request{
-		Method:        "PUT",
-		URL:           u,
-		Body:          ioutil.NopCloser(bytes.NewReader(reqBody.Buffer())),
-		GetBody:       func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(reqBody.Buffer())), nil },
-		ContentLength: int64(len(reqBody.Buffer())),
-		Close:         true,
-		Host:          u.Host,
-		Header:        make(http.Header),
-	}
-	r.Header.Set(consts.AuthHeaderName, clt.Token())
-	resp, err := cleanhttp.DefaultClient().Do(r.WithContext(ctx))
+	// the request goes through the Vault client, so that it uses the same TLS
+	// configuration and namespace as the login
+	r := clt.NewRequest("PUT", fmt.Sprintf("/v1/%s/sign/%s", sshMount, sshRole))
+	r.BodyBytes = reqBody.Buffer()
+	resp, err := clt.RawRequestWithContext(ctx, r)
 	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == 401 || resp.StatusCode == 403 {
+				return nil, &AuthError{Err: err}
+			}
+		}
 		return nil, err
 	}
 	b, err := ioutil.ReadAll(resp.Body)
@@ -0,0 +1,166 @@
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	tests := []struct {
+		values    []string
+		needValue bool
+		want      map[string]string
+		err       bool
+	}{
+		{values: nil, want: nil},
+		{values: []string{"permit-pty"}, want: map[string]string{"permit-pty": ""}},
+		{values: []string{" permit-pty ", "", "  "}, want: map[string]string{"permit-pty": ""}},
+		{values: []string{"force-command=/bin/ls -l"}, want: map[string]string{"force-command": "/bin/ls -l"}},
+		{values: []string{"source-address = 10.0.0.0/8,127.0.0.1 "}, needValue: true, want: map[string]string{"source-address": "10.0.0.0/8,127.0.0.1"}},
+		{values: []string{"opt=a=b"}, want: map[string]string{"opt": "a=b"}},
+		{values: []string{"opt="}, needValue: true, want: map[string]string{"opt": ""}},
+		{values: []string{"opt=1", "opt=2"}, want: map[string]string{"opt": "2"}},
+		{values: []string{"force-command"}, needValue: true, err: true},
+		{values: []string{"=value"}, err: true},
+		{values: []string{" = value"}, needValue: true, err: true},
+	}
+	for _, test := range tests {
+		got, err := parseKeyValues(test.values, test.needValue)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseKeyValues(%q): expected an error, got %v", test.values, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseKeyValues(%q) = %v, %v, want %v", test.values, got, err, test.want)
+		}
+	}
+}
+
+func TestSignOptionsString(t *testing.T) {
+	base := SignOptions{
+		TTL:             time.Hour,
+		Principals:      []string{"admin"},
+		Extensions:      map[string]string{"permit-pty": "", "permit-agent-forwarding": ""},
+		CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"},
+		KeyID:           "bob",
+	}
+	same := base
+	same.Extensions = map[string]string{"permit-agent-forwarding": "", "permit-pty": ""}
+	if base.String() != same.String() {
+		t.Errorf("the order of the extensions changes the options: %s, %s", base, same)
+	}
+	tests := map[string]func(o *SignOptions){
+		"ttl":              func(o *SignOptions) { o.TTL = 2 * time.Hour },
+		"principals":       func(o *SignOptions) { o.Principals = []string{"admin", "root"} },
+		"extension":        func(o *SignOptions) { o.Extensions = map[string]string{"permit-pty": ""} },
+		"critical option":  func(o *SignOptions) { o.CriticalOptions = map[string]string{"force-command": "ls"} },
+		"key ID":           func(o *SignOptions) { o.KeyID = "alice" },
+		"moved to options": func(o *SignOptions) { o.Extensions, o.CriticalOptions = o.CriticalOptions, o.Extensions },
+	}
+	for name, change := range tests {
+		o := base
+		change(&o)
+		if o.String() == base.String() {
+			t.Errorf("%s: the options are not told apart: %s", name, o)
+		}
+	}
+	if (SignOptions{}).String() != (SignOptions{Extensions: map[string]string{}}).String() {
+		t.Error("nil and empty extensions are told apart")
+	}
+}
+
+func TestSign(t *testing.T) {
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = nil
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		switch r.URL.Path {
+		case "/v1/ssh/sign/admin":
+			_, _ = w.Write([]byte(`{"data":{"signed_key":"ssh-ed25519-cert-v01@openssh.com AAAA"}}`))
+		case "/v1/ssh/sign/denied":
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		default:
+			_, _ = w.Write([]byte(`{"errors":["unknown role"]}`))
+		}
+	}))
+	defer server.Close()
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("token")
+	_, pub, err := GenerateEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := zap.NewNop().Sugar()
+
+	tests := []struct {
+		name    string
+		opts    SignOptions
+		request map[string]interface{}
+	}{
+		{
+			name:    "defaults of the role",
+			request: map[string]interface{}{"valid_principals": "bob", "cert_type": "user"},
+		},
+		{
+			name: "options",
+			opts: SignOptions{
+				TTL:             90 * time.Minute,
+				Principals:      []string{"admin", "deploy"},
+				Extensions:      map[string]string{"permit-pty": ""},
+				CriticalOptions: map[string]string{"force-command": "ls"},
+				KeyID:           "bob@laptop",
+			},
+			request: map[string]interface{}{
+				"valid_principals": "bob,admin,deploy",
+				"cert_type":        "user",
+				"ttl":              "5400s",
+				"extensions":       map[string]interface{}{"permit-pty": ""},
+				"critical_options": map[string]interface{}{"force-command": "ls"},
+				"key_id":           "bob@laptop",
+			},
+		},
+	}
+	for _, test := range tests {
+		signed, err := Sign(context.Background(), pub, "bob", "ssh", "admin", test.opts, client, l)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if string(signed.Buffer()) != "ssh-ed25519-cert-v01@openssh.com AAAA" {
+			t.Errorf("%s: got %q", test.name, signed.Buffer())
+		}
+		signed.Destroy()
+		if request["public_key"] == "" || request["public_key"] == nil {
+			t.Errorf("%s: no public key in the request", test.name)
+		}
+		delete(request, "public_key")
+		if !reflect.DeepEqual(request, test.request) {
+			t.Errorf("%s: got request %v, want %v", test.name, request, test.request)
+		}
+	}
+
+	_, err = Sign(context.Background(), pub, "bob", "ssh", "denied", SignOptions{}, client, l)
+	if _, ok := err.(*AuthError); !ok {
+		t.Errorf("denied: got %v, want an AuthError", err)
+	}
+	_, err = Sign(context.Background(), pub, "bob", "ssh", "other", SignOptions{}, client, l)
+	if err == nil || err.Error() != "unknown role" {
+		t.Errorf("other: got %v", err)
+	}
+}
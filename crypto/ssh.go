@@ -1,10 +1,13 @@
 package crypto
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/awnumar/memguard"
 	"github.com/hashicorp/vault/api"
@@ -22,16 +25,36 @@ type SSHCredentials struct {
 	PublicKey   *PublicKey
 	Certificate *memguard.LockedBuffer
 	Password    *memguard.LockedBuffer
+	AgentSigner ssh.Signer
 	Agent       bool
+	// Ephemeral is set for the ephemeral private keys, never written to disk
+	Ephemeral bool
 }
 
 func (c SSHCredentials) AuthMethod() (ssh.AuthMethod, error) {
+	signers, err := c.signers()
+	if err != nil {
+		return nil, err
+	}
+	if signers == nil {
+		return ssh.Password(string(c.Password.Buffer())), nil
+	}
+	return ssh.PublicKeysCallback(signers), nil
+}
+
+// signers returns the callback that gives the signers of the public key
+// credentials: a private key, a certificate, or the SSH agent. It returns nil
+// for a password.
+func (c SSHCredentials) signers() (func() ([]ssh.Signer, error), error) {
+	single := func(signer ssh.Signer) func() ([]ssh.Signer, error) {
+		return func() ([]ssh.Signer, error) { return []ssh.Signer{signer}, nil }
+	}
 	if c.PrivateKey != nil && c.Certificate != nil {
 		ce, err := gssh.ParseCertificate(c.Certificate.Buffer())
 		if err != nil {
 			return nil, err
 		}
-		s, err := ssh.ParsePrivateKey(c.PrivateKey.Buffer())
+		s, err := NewSealedSigner(c.PrivateKey)
 		if err != nil {
 			return nil, err
 		}
@@ -39,29 +62,40 @@ func (c SSHCredentials) AuthMethod() (ssh.AuthMethod, error) {
 		if err != nil {
 			return nil, err
 		}
-		return ssh.PublicKeys(signer), nil
+		return single(signer), nil
 	}
 	if c.PrivateKey != nil && c.Certificate == nil {
-		s, err := ssh.ParsePrivateKey(c.PrivateKey.Buffer())
+		s, err := NewSealedSigner(c.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		return single(s), nil
+	}
+	if c.AgentSigner != nil && c.Certificate != nil {
+		ce, err := gssh.ParseCertificate(c.Certificate.Buffer())
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewCertSigner(ce, c.AgentSigner)
 		if err != nil {
 			return nil, err
 		}
-		return ssh.PublicKeys(s), nil
+		return single(signer), nil
 	}
 	if c.Password != nil {
-		return ssh.Password(string(c.Password.Buffer())), nil
+		return nil, nil
 	}
 	if c.Agent {
-		agent, err := GetAgentAuth()
+		ag, err := agentClient()
 		if err != nil {
 			return nil, err
 		}
-		return agent, nil
+		return ag.Signers, nil
 	}
 	return nil, errors.New("no credentials")
 }
 
-func GetAgentAuth() (ssh.AuthMethod, error) {
+func agentClient() (agent.ExtendedAgent, error) {
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	if len(sock) == 0 {
 		return nil, errors.New("SSH_AUTH_SOCK is not set")
@@ -70,99 +104,407 @@ func GetAgentAuth() (ssh.AuthMethod, error) {
 	if err != nil {
 		return nil, err
 	}
-	ag := agent.NewClient(agconn)
+	return agent.NewClient(agconn), nil
+}
+
+func GetAgentAuth() (ssh.AuthMethod, error) {
+	ag, err := agentClient()
+	if err != nil {
+		return nil, err
+	}
 	auth := ssh.PublicKeysCallback(ag.Signers)
 	return auth, nil
 }
 
+// GetAgentSigners returns the signers of the SSH agent keys. Certificates held
+// by the agent are ignored. If selector is not empty, only the keys whose
+// SHA256 fingerprint or comment contain selector are returned.
+func GetAgentSigners(selector string) ([]ssh.Signer, error) {
+	ag, err := agentClient()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ag.List()
+	if err != nil {
+		return nil, err
+	}
+	signers, err := ag.Signers()
+	if err != nil {
+		return nil, err
+	}
+	var selected []ssh.Signer
+	for _, key := range keys {
+		if strings.HasSuffix(key.Format, "-cert-v01@openssh.com") {
+			continue
+		}
+		if selector != "" && !strings.Contains(ssh.FingerprintSHA256(key), selector) && !strings.Contains(key.Comment, selector) {
+			continue
+		}
+		for _, signer := range signers {
+			if bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+				selected = append(selected, signer)
+				break
+			}
+		}
+	}
+	return selected, nil
+}
+
+// CredentialsToMethods returns the auth methods for the credentials. All the
+// public key credentials are grouped in a single method, in order: the SSH
+// client does not try a method again once it has failed.
 func CredentialsToMethods(credentials []SSHCredentials, logger *zap.SugaredLogger) (methods []ssh.AuthMethod) {
+	var callbacks []func() ([]ssh.Signer, error)
+	var passwords []ssh.AuthMethod
 	for _, credential := range credentials {
-		m, err := credential.AuthMethod()
-		if err == nil {
-			methods = append(methods, m)
-		} else {
+		cb, err := credential.signers()
+		if err != nil {
 			logger.Errorw("failed to use credentials", "error", err)
+		} else if cb == nil {
+			passwords = append(passwords, ssh.Password(string(credential.Password.Buffer())))
+		} else {
+			callbacks = append(callbacks, cb)
 		}
 	}
-	return methods
+	if len(callbacks) > 0 {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var signers []ssh.Signer
+			for _, cb := range callbacks {
+				s, err := cb()
+				if err != nil {
+					logger.Errorw("failed to get signers", "error", err)
+					continue
+				}
+				signers = append(signers, s...)
+			}
+			return signers, nil
+		}))
+	}
+	return append(methods, passwords...)
 }
 
-func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName string, useAgent bool, l *zap.SugaredLogger) (*api.Client, []SSHCredentials, error) {
-	var credentials []SSHCredentials
-	var vaultClient *api.Client
+// JumpCredentials holds the parameters and the credentials of a jump host.
+type JumpCredentials struct {
+	Params      params.SSHParams
+	Credentials []SSHCredentials
+}
 
-	vaultParams := vault.GetVaultParams(clictx)
-	if vaultParams.SSHMount != "" {
-		if vaultParams.SSHRole != "" {
-			client, err := vault.GetVaultClient(ctx, vaultParams, l)
-			if err == nil {
-				vaultClient = client
-			} else if err == context.Canceled {
-				return nil, nil, err
-			} else {
-				l.Errorw("vault auth failed", "error", err)
-			}
+// GetJumpCredentials returns the parameters and the credentials for the jump
+// hosts of proxyJump. Each jump host gets its own certificate, signed with the
+// Vault role of its host mapping.
+func GetJumpCredentials(ctx context.Context, clictx params.CLIContext, proxyJump string, l *zap.SugaredLogger) ([]JumpCredentials, error) {
+	hosts, err := params.ParseJumpHosts(proxyJump)
+	if err != nil {
+		return nil, err
+	}
+	jumps := make([]JumpCredentials, 0, len(hosts))
+	for _, host := range hosts {
+		jumpctx := clictx.ForJumpHost(host)
+		sshParams, err := params.GetSSHParams(jumpctx)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %s", host, err)
+		}
+		_, credentials, err := GetSSHCredentials(ctx, jumpctx, sshParams.LoginName, sshParams.UseAgent, l)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %s", host, err)
+		}
+		jumps = append(jumps, JumpCredentials{Params: sshParams, Credentials: credentials})
+	}
+	return jumps, nil
+}
 
-		} else {
-			l.Infow("vault SSH role is not set")
+// ResolveJumps sets the parameters and the auth methods of the jump hosts of
+// sshParams.ProxyJump in sshParams.Jumps, so that lib.Dial connects through
+// them.
+func ResolveJumps(ctx context.Context, clictx params.CLIContext, sshParams *params.SSHParams, l *zap.SugaredLogger) error {
+	jumps, err := GetJumpCredentials(ctx, clictx, sshParams.ProxyJump, l)
+	if err != nil {
+		return err
+	}
+	hops := make([]params.JumpHop, 0, len(jumps))
+	for _, jump := range jumps {
+		methods := CredentialsToMethods(jump.Credentials, l)
+		if len(methods) == 0 {
+			return fmt.Errorf("jump host %s: no usable credentials", jump.Params.Host)
 		}
-	} else {
+		hops = append(hops, params.JumpHop{Params: jump.Params, Auth: methods})
+	}
+	sshParams.Jumps = hops
+	return nil
+}
+
+// GetAuthMethods returns the auth methods to connect to the host of
+// sshParams, and resolves its jump hosts with ResolveJumps.
+func GetAuthMethods(ctx context.Context, clictx params.CLIContext, sshParams *params.SSHParams, l *zap.SugaredLogger) ([]ssh.AuthMethod, error) {
+	_, credentials, err := GetSSHCredentials(ctx, clictx, sshParams.LoginName, sshParams.UseAgent, l)
+	if err != nil {
+		return nil, err
+	}
+	methods := CredentialsToMethods(credentials, l)
+	if len(methods) == 0 {
+		return nil, errors.New("no usable credentials")
+	}
+	err = ResolveJumps(ctx, clictx, sshParams, l)
+	if err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// lazyVaultClient authenticates to Vault only when a client is actually
+// needed, so that cached certificates can be used without any Vault access.
+type lazyVaultClient struct {
+	params params.VaultParams
+	client *api.Client
+	done   bool
+}
+
+func (v *lazyVaultClient) get(ctx context.Context, l *zap.SugaredLogger) (*api.Client, error) {
+	if v.done {
+		return v.client, nil
+	}
+	v.done = true
+	if v.params.SSHMount == "" {
 		l.Infow("vault SSH mount point is not set")
+		return nil, nil
+	}
+	if v.params.SSHRole == "" {
+		l.Infow("vault SSH role is not set")
+		return nil, nil
 	}
+	client, err := vault.GetVaultClient(ctx, v.params, l)
+	if err == nil {
+		v.client = client
+	} else if err == context.Canceled {
+		return nil, err
+	} else {
+		l.Errorw("vault auth failed", "error", err)
+	}
+	return v.client, nil
+}
 
-	if useAgent {
-		l.Infow("enabled: auth by SSH agent")
-		return vaultClient, []SSHCredentials{{Agent: true}}, nil
+// signCached returns a certificate for the public key, from the cache if
+// possible, or else signed by Vault. It returns nil if Vault is not available.
+func signCached(ctx context.Context, pub *PublicKey, login string, opts SignOptions, vaultClient *lazyVaultClient, cache *CertCache, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
+	mount, role := vaultClient.params.SSHMount, vaultClient.params.SSHRole
+	if cache != nil && mount != "" && role != "" {
+		cert, err := cache.Get(pub, login, vaultClient.params, opts.String())
+		if err != nil {
+			l.Warnw("failed to read certificate from cache", "error", err)
+		} else if cert != nil {
+			l.Infow("using cached certificate")
+			return cert, nil
+		}
+	}
+	client, err := vaultClient.get(ctx, l)
+	if err != nil || client == nil {
+		return nil, err
+	}
+	signed, err := Sign(ctx, pub, login, mount, role, opts, client, l)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		err := cache.Put(pub, login, vaultClient.params, opts.String(), signed)
+		if err != nil {
+			l.Warnw("failed to write certificate to cache", "error", err)
+		}
 	}
+	return signed, nil
+}
 
-	privateKeyPath := clictx.PrivateKey()
-	if privateKeyPath == "" {
-		privateKeyPath = "~/.ssh/id_rsa"
+// getAgentCredentials asks Vault to sign the public keys held by the SSH agent.
+func getAgentCredentials(ctx context.Context, selector, loginName string, opts SignOptions, vaultClient *lazyVaultClient, cache *CertCache, l *zap.SugaredLogger) ([]SSHCredentials, error) {
+	var credentials []SSHCredentials
+	signers, err := GetAgentSigners(selector)
+	if err != nil {
+		l.Warnw("failed to list SSH agent keys", "error", err)
+	}
+	if len(signers) > 0 && selector == "" {
+		signers = signers[:1]
 	}
-	p, err := homedir.Expand(privateKeyPath)
+	for _, signer := range signers {
+		fingerprint := ssh.FingerprintSHA256(signer.PublicKey())
+		// copy the public key, as the agent signer may share its blob
+		pubBytes := append([]byte(nil), signer.PublicKey().Marshal()...)
+		pubBuf, err := memguard.NewImmutableFromBytes(pubBytes)
+		if err != nil {
+			return nil, err
+		}
+		pubkey := (*PublicKey)(pubBuf)
+		signed, err := signCached(ctx, pubkey, loginName, opts, vaultClient, cache, l)
+		if err == context.Canceled {
+			return nil, err
+		}
+		if err != nil {
+			l.Warnw("failed to sign SSH agent key", "key", fingerprint, "error", err)
+			continue
+		}
+		if signed != nil {
+			credentials = append(credentials, SSHCredentials{
+				PublicKey:   pubkey,
+				Certificate: signed,
+				AgentSigner: signer,
+			})
+			l.Infow("enabled: key from SSH agent, signed by vault", "key", fingerprint)
+		}
+	}
+	credentials = append(credentials, SSHCredentials{Agent: true})
+	l.Infow("enabled: auth by SSH agent")
+	return credentials, nil
+}
+
+// getEphemeralCredentials generates a new private key and asks Vault to sign it.
+func getEphemeralCredentials(ctx context.Context, loginName string, opts SignOptions, vaultClient *lazyVaultClient, l *zap.SugaredLogger) ([]SSHCredentials, error) {
+	client, err := vaultClient.get(ctx, l)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.New("ephemeral keys need Vault to sign them")
+	}
+	privkey, pubkey, err := GenerateEphemeralKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %s", err)
+	}
+	signed, err := Sign(ctx, pubkey, loginName, vaultClient.params.SSHMount, vaultClient.params.SSHRole, opts, client, l)
+	if err == context.Canceled {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign ephemeral key: %s", err)
+	}
+	l.Infow("enabled: ephemeral private key, signed by vault", "ttl", opts.TTL)
+	return []SSHCredentials{
+		{
+			PrivateKey:  privkey,
+			PublicKey:   pubkey,
+			Certificate: signed,
+			Ephemeral:   true,
+		},
+	}, nil
+}
+
+// GetSignOptions returns the options of the signing requests to Vault.
+func GetSignOptions(clictx params.CLIContext) (SignOptions, error) {
+	opts := SignOptions{
+		TTL:        clictx.CertTTL(),
+		Principals: clictx.CertPrincipals(),
+		KeyID:      clictx.CertKeyID(),
+	}
+	if opts.TTL == 0 && clictx.Ephemeral() {
+		opts.TTL = clictx.EphemeralTTL()
+	}
+	extensions, err := parseKeyValues(clictx.CertExtensions(), false)
+	if err != nil {
+		return opts, fmt.Errorf("invalid certificate extension: %s", err)
+	}
+	opts.Extensions = extensions
+	criticalOptions, err := parseKeyValues(clictx.CertCriticalOptions(), true)
+	if err != nil {
+		return opts, fmt.Errorf("invalid certificate critical option: %s", err)
 	}
-	privateKeyPath = p
+	opts.CriticalOptions = criticalOptions
+	return opts, nil
+}
+
+func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName string, useAgent bool, l *zap.SugaredLogger) (*api.Client, []SSHCredentials, error) {
+	var credentials []SSHCredentials
 
-	var pubkeyFS *PublicKey
-	privkeyFS, err := ReadPrivateKeyFromFileSystem(privateKeyPath)
+	vaultClient := &lazyVaultClient{params: params.GetVaultParams(clictx)}
+	opts, err := GetSignOptions(clictx)
 	if err != nil {
-		l.Infow("failed to read private key from filesystem", "path", privateKeyPath, "error", err)
-	} else {
-		pubkey, err := DerivePublicKey(privkeyFS)
+		return nil, nil, err
+	}
+
+	switch clictx.VaultSSHMode() {
+	case "", "ca":
+	case "otp":
+		if clictx.Ephemeral() {
+			return nil, nil, errors.New("ephemeral keys can't be used in OTP mode")
+		}
+		host := clictx.SSHHost()
+		if sshConfig, err := clictx.SSHConfig(); err == nil && sshConfig.HostName != "" {
+			host = sshConfig.HostName
+		}
+		credentials, err := getOTPCredentials(ctx, host, loginName, vaultClient, l)
 		if err != nil {
-			l.Warnw("failed to derive public key from filesystem private key", "error", err)
-		} else {
-			pubkeyFS = pubkey
+			return nil, nil, err
+		}
+		return vaultClient.client, credentials, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown vault SSH mode: %s", clictx.VaultSSHMode())
+	}
+
+	if clictx.Ephemeral() {
+		// ephemeral keys are never reused, so their certificates are not cached
+		credentials, err := getEphemeralCredentials(ctx, loginName, opts, vaultClient, l)
+		if err != nil {
+			return nil, nil, err
 		}
+		return vaultClient.client, credentials, nil
 	}
-	var certificateFS *memguard.LockedBuffer
-	if pubkeyFS != nil {
-		certificatePath := privateKeyPath + "-cert.pub"
-		_, err := os.Stat(certificatePath)
+
+	var cache *CertCache
+	if clictx.CertCache() {
+		c, err := OpenCertCache()
 		if err == nil {
-			cert, err := ReadCertificateFromFileSystem(certificatePath)
-			if err == nil {
-				certificateFS = cert
-			} else {
-				l.Warnw("failed to read certificate from filesystem", "error", err)
-			}
+			cache = c
+			defer cache.Close()
 		} else {
-			l.Infow("matching certificate not found for filesystem private key", "error", err)
+			l.Warnw("failed to open certificates cache", "error", err)
 		}
 	}
 
+	if useAgent {
+		credentials, err := getAgentCredentials(ctx, clictx.SSHAgentKey(), loginName, opts, vaultClient, cache, l)
+		if err != nil {
+			return nil, nil, err
+		}
+		return vaultClient.client, credentials, nil
+	}
+
+	// the host mapping and ssh_config are empty when --privkey is given on
+	// the command line, but take precedence over a profile
+	var privateKeyPaths []string
+	if mapping, err := clictx.HostMapping(); err == nil && mapping.Key != "" {
+		privateKeyPaths = []string{mapping.Key}
+	}
+	if sshConfig, err := clictx.SSHConfig(); err == nil {
+		privateKeyPaths = append(privateKeyPaths, sshConfig.IdentityFiles...)
+	}
+	if len(privateKeyPaths) == 0 {
+		privateKeyPaths = clictx.PrivateKeys()
+	}
+	discovered := false
+	if len(privateKeyPaths) == 0 {
+		privateKeyPaths = DefaultIdentities
+		discovered = true
+	}
+	identities, err := readIdentities(privateKeyPaths, discovered, l)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	privateKeyVaultPath := clictx.VPrivateKey()
 	var privkeyVault *memguard.LockedBuffer
-	if vaultClient != nil && privateKeyVaultPath != "" {
-		pkey, err := vault.ReadPrivateKeyFromVault(ctx, privateKeyVaultPath, vaultClient, l)
-		if err == nil {
-			privkeyVault = pkey
-		} else if err == context.Canceled {
+	if privateKeyVaultPath != "" {
+		client, err := vaultClient.get(ctx, l)
+		if err != nil {
 			return nil, nil, err
-		} else {
-			l.Warnw("failed to read private key from vault", "error", err)
+		}
+		if client != nil {
+			pkey, err := vault.ReadPrivateKeyFromVault(ctx, privateKeyVaultPath, client, l)
+			if err == nil {
+				pkey, err = UnlockPrivateKey(pkey, "Enter the passphrase for the private key from Vault")
+			}
+			if err == nil {
+				privkeyVault = pkey
+			} else if err == context.Canceled {
+				return nil, nil, err
+			} else {
+				l.Warnw("failed to read private key from vault", "error", err)
+			}
 		}
 	}
 	var pubkeyVault *PublicKey
@@ -176,8 +518,8 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 	}
 
 	var certificatePKVault *memguard.LockedBuffer
-	if pubkeyVault != nil && vaultClient != nil {
-		signed, err := Sign(ctx, pubkeyVault, loginName, vaultParams.SSHMount, vaultParams.SSHRole, vaultClient, l)
+	if pubkeyVault != nil {
+		signed, err := signCached(ctx, pubkeyVault, loginName, opts, vaultClient, cache, l)
 		if err == nil {
 			certificatePKVault = signed
 		} else if err == context.Canceled {
@@ -186,15 +528,16 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 			l.Warnw("failed to sign vault private key", "error", err)
 		}
 	}
-	var certificatePKFS *memguard.LockedBuffer
-	if certificatePKVault == nil && pubkeyFS != nil && vaultClient != nil {
-		signed, err := Sign(ctx, pubkeyFS, loginName, vaultParams.SSHMount, vaultParams.SSHRole, vaultClient, l)
-		if err == nil {
-			certificatePKFS = signed
-		} else if err == context.Canceled {
-			return nil, nil, err
-		} else {
-			l.Warnw("failed to sign filesystem private key", "error", err)
+	if certificatePKVault == nil {
+		for _, identity := range identities {
+			signed, err := signCached(ctx, identity.pubkey, loginName, opts, vaultClient, cache, l)
+			if err == nil {
+				identity.signed = signed
+			} else if err == context.Canceled {
+				return nil, nil, err
+			} else {
+				l.Warnw("failed to sign filesystem private key", "path", identity.path, "error", err)
+			}
 		}
 	}
 
@@ -206,13 +549,15 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 		})
 		l.Infow("enabled: private key from vault, signed by vault")
 	}
-	if certificatePKFS != nil {
-		credentials = append(credentials, SSHCredentials{
-			PrivateKey:  privkeyFS,
-			PublicKey:   pubkeyFS,
-			Certificate: certificatePKFS,
-		})
-		l.Infow("enabled: private key from filesystem, signed by vault")
+	for _, identity := range identities {
+		if identity.signed != nil {
+			credentials = append(credentials, SSHCredentials{
+				PrivateKey:  identity.privkey,
+				PublicKey:   identity.pubkey,
+				Certificate: identity.signed,
+			})
+			l.Infow("enabled: private key from filesystem, signed by vault", "path", identity.path)
+		}
 	}
 	if pubkeyVault != nil {
 		credentials = append(credentials, SSHCredentials{
@@ -221,21 +566,20 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 		})
 		l.Infow("enabled: private key from vault, no certificate")
 	}
-	if pubkeyFS != nil {
-		if certificateFS != nil {
+	for _, identity := range identities {
+		if identity.certificate != nil {
 			credentials = append(credentials, SSHCredentials{
-				PrivateKey:  privkeyFS,
-				PublicKey:   pubkeyFS,
-				Certificate: certificateFS,
+				PrivateKey:  identity.privkey,
+				PublicKey:   identity.pubkey,
+				Certificate: identity.certificate,
 			})
-			l.Infow("enabled: private key and certificate from filesystem")
+			l.Infow("enabled: private key and certificate from filesystem", "path", identity.path)
 		}
-
 		credentials = append(credentials, SSHCredentials{
-			PrivateKey: privkeyFS,
-			PublicKey:  pubkeyFS,
+			PrivateKey: identity.privkey,
+			PublicKey:  identity.pubkey,
 		})
-		l.Infow("enabled: private key from filesystem, no certificate")
+		l.Infow("enabled: private key from filesystem, no certificate", "path", identity.path)
 	}
 	if clictx.SSHPassword() {
 		pass, err := InputPassword("Enter SSH password")
@@ -247,5 +591,67 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 		})
 		l.Infow("enabled: SSH password")
 	}
-	return vaultClient, credentials, nil
+	return vaultClient.client, credentials, nil
+}
+
+// DefaultIdentities are the private keys that are tried when no private key is
+// given, in that order, like OpenSSH does.
+var DefaultIdentities = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+type identity struct {
+	path        string
+	privkey     *memguard.LockedBuffer
+	pubkey      *PublicKey
+	certificate *memguard.LockedBuffer
+	signed      *memguard.LockedBuffer
+}
+
+// readIdentities reads the private keys at the given paths, and the matching
+// certificates found next to them. The keys that can't be read are skipped.
+// If discovered is true, the paths are the default ones, and the missing
+// files are silently ignored.
+func readIdentities(paths []string, discovered bool, l *zap.SugaredLogger) ([]*identity, error) {
+	var identities []*identity
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		p, err := homedir.Expand(path)
+		if err != nil {
+			return nil, err
+		}
+		if discovered {
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				l.Debugw("default private key not found", "path", p)
+				continue
+			}
+		}
+		privkey, err := ReadPrivateKeyFromFileSystem(p)
+		if err != nil {
+			l.Infow("failed to read private key from filesystem", "path", p, "error", err)
+			continue
+		}
+		pubkey, err := DerivePublicKey(privkey)
+		if err != nil {
+			l.Warnw("failed to derive public key from filesystem private key", "path", p, "error", err)
+			continue
+		}
+		if seen[string(pubkey.Buffer())] {
+			continue
+		}
+		seen[string(pubkey.Buffer())] = true
+		id := &identity{path: p, privkey: privkey, pubkey: pubkey}
+		certificatePath := p + "-cert.pub"
+		_, err = os.Stat(certificatePath)
+		if err == nil {
+			cert, err := ReadCertificateFromFileSystem(certificatePath)
+			if err == nil {
+				id.certificate = cert
+			} else {
+				l.Warnw("failed to read certificate from filesystem", "path", certificatePath, "error", err)
+			}
+		} else {
+			l.Infow("matching certificate not found for filesystem private key", "error", err)
+		}
+		identities = append(identities, id)
+	}
+	return identities, nil
 }
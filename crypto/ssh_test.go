@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// authenticate connects to a SSH server that only accepts the public key
+// accepted, with the auth methods.
+func authenticate(t *testing.T, accepted ssh.PublicKey, methods []ssh.AuthMethod) error {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), accepted.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for range chans {
+		}
+	}()
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		Auth:            methods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func TestCredentialsToMethods(t *testing.T) {
+	var credentials []SSHCredentials
+	var keys []ssh.PublicKey
+	for i := 0; i < 3; i++ {
+		privkey, _, err := GenerateEphemeralKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := NewSealedSigner(privkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		credentials = append(credentials, SSHCredentials{PrivateKey: privkey})
+		keys = append(keys, signer.PublicKey())
+	}
+	methods := CredentialsToMethods(credentials, zap.NewNop().Sugar())
+	if len(methods) != 1 {
+		t.Fatalf("got %d auth methods, want 1", len(methods))
+	}
+	// the SSH client tries each method once, so every key must be offered
+	// by the same method
+	for i, key := range keys {
+		if err := authenticate(t, key, methods); err != nil {
+			t.Errorf("key %d: %s", i, err)
+		}
+	}
+	other, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(t, other.PublicKey(), methods); err == nil {
+		t.Error("authenticated with an unknown key")
+	}
+}
@@ -0,0 +1,429 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/vault"
+
+	"github.com/awnumar/memguard"
+	"github.com/hashicorp/vault/api"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errAgentLocked = errors.New("agent is locked")
+var errAgentReadOnly = errors.New("the vssh agent does not accept new identities")
+
+type agentIdentity struct {
+	privkey *memguard.LockedBuffer
+	pubkey  *crypto.PublicKey
+	cert    *memguard.LockedBuffer
+}
+
+func (id *agentIdentity) signer() (ssh.Signer, error) {
+	s, err := crypto.NewSealedSigner(id.privkey)
+	if err != nil {
+		return nil, err
+	}
+	if id.cert == nil {
+		return s, nil
+	}
+	ce, err := gssh.ParseCertificate(id.cert.Buffer())
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewCertSigner(ce, s)
+}
+
+// VaultAgent is a read-only SSH agent that serves private keys and their
+// certificates signed by Vault. The certificates are signed again by Vault
+// before they expire.
+type VaultAgent struct {
+	mu          sync.Mutex
+	identities  []*agentIdentity
+	login       string
+	vaultParams params.VaultParams
+	signOpts    crypto.SignOptions
+	// client is only used by the renewal goroutine, without mu
+	client     *api.Client
+	passphrase []byte
+	logger     *zap.SugaredLogger
+}
+
+// NewVaultAgent creates an agent for the private keys found in credentials.
+func NewVaultAgent(credentials []crypto.SSHCredentials, login string, vaultParams params.VaultParams, signOpts crypto.SignOptions, client *api.Client, l *zap.SugaredLogger) *VaultAgent {
+	a := &VaultAgent{
+		login:       login,
+		vaultParams: vaultParams,
+		signOpts:    signOpts,
+		client:      client,
+		logger:      l,
+	}
+	for _, credential := range credentials {
+		if credential.PrivateKey == nil || credential.PublicKey == nil {
+			continue
+		}
+		id := a.find(credential.PublicKey.Buffer())
+		if id == nil {
+			a.identities = append(a.identities, &agentIdentity{
+				privkey: credential.PrivateKey,
+				pubkey:  credential.PublicKey,
+				cert:    credential.Certificate,
+			})
+		} else if id.cert == nil {
+			id.cert = credential.Certificate
+		}
+	}
+	return a
+}
+
+func (a *VaultAgent) find(blob []byte) *agentIdentity {
+	for _, id := range a.identities {
+		if bytes.Equal(id.pubkey.Buffer(), blob) {
+			return id
+		}
+		if id.cert != nil {
+			ce, err := gssh.ParseCertificate(id.cert.Buffer())
+			if err == nil && bytes.Equal(ce.Marshal(), blob) {
+				return id
+			}
+		}
+	}
+	return nil
+}
+
+// Len returns the number of private keys held by the agent.
+func (a *VaultAgent) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.identities)
+}
+
+func (a *VaultAgent) List() ([]*agent.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passphrase != nil {
+		return nil, nil
+	}
+	var keys []*agent.Key
+	for _, id := range a.identities {
+		if id.cert != nil {
+			ce, err := gssh.ParseCertificate(id.cert.Buffer())
+			if err == nil {
+				keys = append(keys, &agent.Key{
+					Format:  ce.Type(),
+					Blob:    ce.Marshal(),
+					Comment: fmt.Sprintf("vault certificate %s", ce.KeyId),
+				})
+			}
+		}
+		pub, err := ssh.ParsePublicKey(id.pubkey.Buffer())
+		if err == nil {
+			keys = append(keys, &agent.Key{
+				Format:  pub.Type(),
+				Blob:    pub.Marshal(),
+				Comment: "vssh private key",
+			})
+		}
+	}
+	return keys, nil
+}
+
+func (a *VaultAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *VaultAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passphrase != nil {
+		return nil, errAgentLocked
+	}
+	id := a.find(key.Marshal())
+	if id == nil {
+		return nil, errors.New("not found")
+	}
+	// the private key is parsed only for the duration of the signature
+	s, err := crypto.NewSealedSigner(id.privkey)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Destroy()
+	if flags == 0 {
+		return s.Sign(rand.Reader, data)
+	}
+	var algorithm string
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		algorithm = ssh.SigAlgoRSASHA2256
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		algorithm = ssh.SigAlgoRSASHA2512
+	default:
+		return nil, fmt.Errorf("unsupported signature flags: %d", flags)
+	}
+	return s.SignWithAlgorithm(rand.Reader, data, algorithm)
+}
+
+func (a *VaultAgent) Add(key agent.AddedKey) error {
+	return errAgentReadOnly
+}
+
+func (a *VaultAgent) Remove(key ssh.PublicKey) error {
+	return errAgentReadOnly
+}
+
+func (a *VaultAgent) RemoveAll() error {
+	return errAgentReadOnly
+}
+
+func (a *VaultAgent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passphrase != nil {
+		return errAgentLocked
+	}
+	h := sha256.Sum256(passphrase)
+	a.passphrase = h[:]
+	return nil
+}
+
+func (a *VaultAgent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passphrase == nil {
+		return errors.New("agent is not locked")
+	}
+	h := sha256.Sum256(passphrase)
+	if subtle.ConstantTimeCompare(h[:], a.passphrase) != 1 {
+		return errors.New("incorrect passphrase")
+	}
+	a.passphrase = nil
+	return nil
+}
+
+func (a *VaultAgent) Signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passphrase != nil {
+		return nil, errAgentLocked
+	}
+	signers := make([]ssh.Signer, 0, len(a.identities))
+	for _, id := range a.identities {
+		s, err := id.signer()
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, s)
+	}
+	return signers, nil
+}
+
+func (a *VaultAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// renewAt returns when the certificate should be signed again: before
+// crypto.CertCacheMargin, or a quarter of the certificate lifetime for short
+// lived certificates. It returns the zero time for certificates that never expire.
+func renewAt(cert *memguard.LockedBuffer) (time.Time, error) {
+	ce, err := gssh.ParseCertificate(cert.Buffer())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ce.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}, nil
+	}
+	before := time.Unix(int64(ce.ValidBefore), 0)
+	margin := crypto.CertCacheMargin
+	if ce.ValidAfter != 0 {
+		lifetime := before.Sub(time.Unix(int64(ce.ValidAfter), 0))
+		if lifetime/4 < margin {
+			margin = lifetime / 4
+		}
+	}
+	return before.Add(-margin), nil
+}
+
+func fingerprint(pub *crypto.PublicKey) string {
+	public, err := ssh.ParsePublicKey(pub.Buffer())
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(public)
+}
+
+// due returns the identities whose certificate must be signed now: those
+// without a certificate, and those whose certificate expires soon. It also
+// returns when the next certificate must be signed again.
+func (a *VaultAgent) due() (due []*agentIdentity, next time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for _, id := range a.identities {
+		if id.cert == nil {
+			due = append(due, id)
+			continue
+		}
+		at, err := renewAt(id.cert)
+		if err != nil {
+			due = append(due, id)
+			continue
+		}
+		if at.IsZero() {
+			continue
+		}
+		if at.After(now) {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+			continue
+		}
+		due = append(due, id)
+	}
+	return due, next
+}
+
+// sign asks Vault to sign the public key. When Vault rejects the token, the
+// client is created again, so that the agent recovers once the token has
+// expired.
+func (a *VaultAgent) sign(ctx context.Context, pub *crypto.PublicKey) (*memguard.LockedBuffer, error) {
+	for retry := 0; ; retry++ {
+		if a.client == nil {
+			client, err := vault.GetVaultClient(ctx, a.vaultParams, a.logger)
+			if err != nil {
+				return nil, err
+			}
+			a.client = client
+		}
+		signed, err := crypto.Sign(ctx, pub, a.login, a.vaultParams.SSHMount, a.vaultParams.SSHRole, a.signOpts, a.client, a.logger)
+		if _, ok := err.(*crypto.AuthError); ok && retry == 0 {
+			a.logger.Infow("vault token rejected, authenticating again", "error", err)
+			a.client = nil
+			continue
+		}
+		return signed, err
+	}
+}
+
+// renew signs the certificates that are due. Vault is called without holding
+// mu, so that the agent keeps serving the clients in the meantime. An error
+// for one identity does not prevent the others from being signed: the last
+// error is returned after all of them have been tried.
+func (a *VaultAgent) renew(ctx context.Context) (next time.Time, err error) {
+	due, next := a.due()
+	for _, id := range due {
+		signed, e := a.sign(ctx, id.pubkey)
+		if e == nil {
+			_, e = renewAt(signed)
+		}
+		if e != nil {
+			if e != context.Canceled {
+				a.logger.Warnw("failed to sign certificate", "key", fingerprint(id.pubkey), "error", e)
+			}
+			err = e
+			continue
+		}
+		a.mu.Lock()
+		id.cert = signed
+		a.mu.Unlock()
+		a.logger.Infow("certificate signed by vault", "key", fingerprint(id.pubkey))
+		at, _ := renewAt(signed)
+		if !at.IsZero() && (next.IsZero() || at.Before(next)) {
+			next = at
+		}
+	}
+	return next, err
+}
+
+// Renew signs again the certificates before they expire, until ctx is canceled.
+func (a *VaultAgent) Renew(ctx context.Context) error {
+	for {
+		next, err := a.renew(ctx)
+		wait := time.Until(next)
+		if err == context.Canceled {
+			return err
+		}
+		if err != nil {
+			// the failures have been logged by renew, try again later
+			if next.IsZero() || wait > 30*time.Second {
+				wait = 30 * time.Second
+			}
+		} else if next.IsZero() {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ListenAgent creates the Unix socket path of an agent, only accessible by
+// the user.
+func ListenAgent(path string) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve accepts the agent connections on listener, until ctx is canceled.
+// The listener is closed when Serve returns.
+func (a *VaultAgent) Serve(ctx context.Context, listener net.Listener) error {
+	defer func() { _ = listener.Close() }()
+	// agent.ServeAgent logs the requests it does not support, like the
+	// session-bind extension of OpenSSH, with the standard logger
+	restore, err := zap.RedirectStdLogAt(a.logger.Desugar(), zapcore.DebugLevel)
+	if err == nil {
+		defer restore()
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+				return err
+			}
+		}
+		go func() {
+			err := agent.ServeAgent(a, conn)
+			_ = conn.Close()
+			if err != nil && err != io.EOF {
+				a.logger.Debugw("agent connection closed", "error", err)
+			}
+		}()
+	}
+}
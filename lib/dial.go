@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/stephane-martin/vssh/params"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Dial connects to the SSH server given by sshParams. The auth methods are
+// tried in order, on a single connection. When ServerAliveInterval is set, keepalive messages are sent
+// to the server, and the connection is closed if the server stops answering.
+//
+// When there are jump hosts, the connection to each host is made through the
+// SSH connection to the previous one, like the ProxyJump option of OpenSSH.
+// The connections to the jump hosts are closed with the returned client.
+//
+// gssh.Dial is not used, as it can't dial through the jump hosts or a SOCKS
+// proxy, nor send keepalives. The other gssh helpers dial by themselves, so
+// they are replaced by the functions of session.go that take the client.
+func Dial(ctx context.Context, sshParams params.SSHParams, auth []ssh.AuthMethod, l *zap.SugaredLogger) (*ssh.Client, error) {
+	// the jump hosts are resolved by crypto.ResolveJumps
+	hosts, err := params.ParseJumpHosts(sshParams.ProxyJump)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) != len(sshParams.Jumps) {
+		return nil, fmt.Errorf("the jump hosts %s are not resolved", sshParams.ProxyJump)
+	}
+	first := sshParams
+	if len(sshParams.Jumps) > 0 {
+		first = sshParams.Jumps[0].Params
+	}
+	dial, err := proxyDialer(ctx, sshParams, first.Host, sshPort(first), l)
+	if err != nil {
+		return nil, err
+	}
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			_ = hops[i].Close()
+		}
+	}
+	for _, hop := range sshParams.Jumps {
+		client, err := dialSSH(ctx, dial, hop.Params, hop.Auth, l)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("failed to connect to jump host %s: %s", hop.Params.Host, err)
+		}
+		l.Debugw("connected to jump host", "host", hop.Params.Host, "port", hop.Params.Port)
+		hops = append(hops, client)
+		dial = throughClient(client)
+	}
+	client, err := dialSSH(ctx, dial, sshParams, auth, l)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	if len(hops) > 0 {
+		go func() {
+			_ = client.Wait()
+			closeHops()
+		}()
+	}
+	return client, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// throughClient dials the connections through the SSH client.
+func throughClient(client *ssh.Client) dialFunc {
+	return func(_ context.Context, network, addr string) (net.Conn, error) {
+		return client.Dial(network, addr)
+	}
+}
+
+// dialSSH makes a SSH connection to a single host, with all the auth methods.
+func dialSSH(ctx context.Context, dial dialFunc, sshParams params.SSHParams, auth []ssh.AuthMethod, l *zap.SugaredLogger) (*ssh.Client, error) {
+	if len(auth) == 0 {
+		return nil, errors.New("no auth method")
+	}
+	hkcb, err := MakeHostKeyCallback(ctx, sshParams, l)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(sshParams.Host, strconv.Itoa(sshPort(sshParams)))
+	cfg := &ssh.ClientConfig{
+		User:            sshParams.LoginName,
+		Auth:            auth,
+		HostKeyCallback: hkcb,
+	}
+	client, err := handshake(ctx, dial, addr, cfg)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if sshParams.ServerAliveInterval > 0 {
+		go keepAlive(client, sshParams.ServerAliveInterval, sshParams.ServerAliveCountMax, l)
+	}
+	return client, nil
+}
+
+func sshPort(sshParams params.SSHParams) int {
+	if sshParams.Port == 0 {
+		return 22
+	}
+	return sshParams.Port
+}
+
+func handshake(ctx context.Context, dial dialFunc, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	if ctx.Err() != nil {
+		_ = client.Close()
+		return nil, ctx.Err()
+	}
+	return client, nil
+}
+
+// SFTP connects to the SSH server and starts a SFTP client. The SSH
+// connection is closed when the SFTP client is closed.
+func SFTP(ctx context.Context, sshParams params.SSHParams, auth []ssh.AuthMethod, l *zap.SugaredLogger) (*sftp.Client, error) {
+	conn, err := Dial(ctx, sshParams, auth, l)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go func() {
+		_ = client.Wait()
+		_ = conn.Close()
+	}()
+	return client, nil
+}
+
+// keepAlive sends keepalive requests to the server every interval, like the
+// ServerAliveInterval option of OpenSSH, until the connection is closed.
+func keepAlive(client *ssh.Client, interval time.Duration, countMax int, l *zap.SugaredLogger) {
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-closed:
+			return
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= countMax {
+				l.Warnw("the SSH server does not answer, closing the connection", "missed_keepalives", missed)
+				_ = client.Close()
+				return
+			}
+		}
+	}
+}
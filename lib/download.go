@@ -14,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/stephane-martin/vssh/crypto"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/remoteops"
 	"github.com/stephane-martin/vssh/sys"
@@ -29,19 +30,7 @@ import (
 type Callback func(isDir, endOfDir bool, name string, perms os.FileMode, mtime, atime time.Time, content io.Reader) error
 
 func SFTPClient(gparams params.SSHParams, methods []ssh.AuthMethod, l *zap.SugaredLogger) (*sftp.Client, error) {
-	cfg := gssh.Config{
-		User:      gparams.LoginName,
-		Host:      gparams.Host,
-		Port:      gparams.Port,
-		Auth:      methods,
-		HTTPProxy: gparams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
-	if err != nil {
-		return nil, err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(context.Background(), cfg)
+	client, err := SFTP(context.Background(), gparams, methods, l)
 	if err != nil {
 		return nil, err
 	}
@@ -52,19 +41,7 @@ func SFTPListAuth(ctx context.Context, gparams params.SSHParams, auth []ssh.Auth
 	if len(auth) == 0 {
 		return errors.New("no auth method")
 	}
-	cfg := gssh.Config{
-		User:      gparams.LoginName,
-		Host:      gparams.Host,
-		Port:      gparams.Port,
-		Auth:      auth,
-		HTTPProxy: gparams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(ctx, cfg)
+	client, err := SFTP(ctx, gparams, auth, l)
 	if err != nil {
 		return err
 	}
@@ -93,19 +70,7 @@ func SFTPGetAuth(ctx context.Context, srcs []string, gparams params.SSHParams, a
 	if len(auth) == 0 {
 		return errors.New("no auth method")
 	}
-	cfg := gssh.Config{
-		User:      gparams.LoginName,
-		Host:      gparams.Host,
-		Port:      gparams.Port,
-		Auth:      auth,
-		HTTPProxy: gparams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(ctx, cfg)
+	client, err := SFTP(ctx, gparams, auth, l)
 	if err != nil {
 		return err
 	}
@@ -189,21 +154,8 @@ func ScpGetAuth(ctx context.Context, srcs []string, gparams params.SSHParams, au
 	if len(auth) == 0 {
 		return errors.New("no auth method")
 	}
-	cfg := gssh.Config{
-		User:      gparams.LoginName,
-		Host:      gparams.Host,
-		Port:      gparams.Port,
-		Auth:      auth,
-		HTTPProxy: gparams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-
 	for _, source := range srcs {
-		err := receive(ctx, cfg, source, cb, l)
+		err := receive(ctx, gparams, auth, source, cb, l)
 		if err != nil {
 			return err
 		}
@@ -216,7 +168,7 @@ func makeAuthCertificate(privkey, cert *memguard.LockedBuffer) (ssh.AuthMethod,
 	if err != nil {
 		return nil, err
 	}
-	s, err := ssh.ParsePrivateKey(privkey.Buffer())
+	s, err := crypto.NewSealedSigner(privkey)
 	if err != nil {
 		return nil, err
 	}
@@ -251,7 +203,7 @@ func SFTPList(ctx context.Context, gparams params.SSHParams, privkey, cert *memg
 	return SFTPListAuth(ctx, gparams, []ssh.AuthMethod{a}, l, cb)
 }
 
-func receive(ctx context.Context, cfg gssh.Config, src string, cb Callback, l *zap.SugaredLogger) error {
+func receive(ctx context.Context, gparams params.SSHParams, auth []ssh.AuthMethod, src string, cb Callback, l *zap.SugaredLogger) error {
 	lctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var p string
@@ -263,7 +215,7 @@ func receive(ctx context.Context, cfg gssh.Config, src string, cb Callback, l *z
 	opts := "-q -f -r -p"
 	command := fmt.Sprintf("scp %s %s", opts, p)
 	l.Debugw("remote command", "cmd", command)
-	clt, err := gssh.StartCommand(lctx, cfg, command)
+	clt, err := StartCommand(lctx, gparams, auth, command, l)
 	if err != nil {
 		return err
 	}
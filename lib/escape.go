@@ -0,0 +1,247 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// NoEscape disables the escape character.
+const NoEscape = -1
+
+// ParseEscapeChar parses the -e option, like OpenSSH: a single character,
+// "^" followed by a character for a control character, or "none".
+func ParseEscapeChar(s string) (int, error) {
+	switch {
+	case s == "none":
+		return NoEscape, nil
+	case len(s) == 1:
+		return int(s[0]), nil
+	case len(s) == 2 && s[0] == '^':
+		return int(s[1] & 31), nil
+	default:
+		return 0, fmt.Errorf("bad escape character: %s", s)
+	}
+}
+
+// escapeFilter filters the local standard input of an interactive session,
+// and handles the escape sequences of OpenSSH. They are only recognized at
+// the beginning of a line.
+type escapeFilter struct {
+	r            *bufio.Reader
+	char         byte
+	conn         io.Closer
+	session      *ssh.Session
+	fd           int
+	state        *terminal.State
+	forwards     *forwarder
+	afterNewline bool
+	sawEscape    bool
+	pending      []byte
+	disconnected int32
+}
+
+// newEscapeFilter returns the filter for the session. state is the state of
+// the local terminal before it was put in raw mode.
+func newEscapeFilter(char byte, conn *ssh.Client, session *ssh.Session, fd int, state *terminal.State, l *zap.SugaredLogger) *escapeFilter {
+	return &escapeFilter{
+		r:            bufio.NewReader(os.Stdin),
+		char:         char,
+		conn:         conn,
+		session:      session,
+		fd:           fd,
+		state:        state,
+		forwards:     newForwarder(conn, l),
+		afterNewline: true,
+	}
+}
+
+// Disconnected tells whether the user has closed the connection with ~.
+func (f *escapeFilter) Disconnected() bool {
+	return atomic.LoadInt32(&f.disconnected) == 1
+}
+
+// Close stops the port forwardings.
+func (f *escapeFilter) Close() {
+	f.forwards.closeAll()
+}
+
+func (f *escapeFilter) Read(p []byte) (int, error) {
+	if f.Disconnected() {
+		// the connection is closed, the pending input is dropped
+		return 0, io.EOF
+	}
+	for len(f.pending) == 0 {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		f.filter(b)
+		for len(f.pending) < len(p) && f.r.Buffered() > 0 && !f.Disconnected() {
+			b, _ = f.r.ReadByte()
+			f.filter(b)
+		}
+		if f.Disconnected() {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *escapeFilter) filter(b byte) {
+	if !f.sawEscape {
+		if f.afterNewline && b == f.char {
+			f.sawEscape = true
+			return
+		}
+		f.pending = append(f.pending, b)
+		f.afterNewline = b == '\r' || b == '\n'
+		return
+	}
+	f.sawEscape = false
+	f.afterNewline = true
+	switch b {
+	case '.':
+		f.printf("%s.\r\n", f.escapeString())
+		atomic.StoreInt32(&f.disconnected, 1)
+		_ = f.conn.Close()
+	case 'Z' & 31:
+		f.printf("%s^Z [suspend ssh]\r\n", f.escapeString())
+		f.suspend()
+	case '#':
+		f.printf("%s#\r\n", f.escapeString())
+		f.listForwards()
+	case '?':
+		f.printf("%s?\r\n", f.escapeString())
+		f.help()
+	case 'C':
+		f.commandLine()
+	case f.char:
+		f.pending = append(f.pending, b)
+		f.afterNewline = false
+	default:
+		f.pending = append(f.pending, f.char, b)
+		f.afterNewline = b == '\r' || b == '\n'
+	}
+}
+
+func (f *escapeFilter) printf(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(os.Stderr, format, args...)
+}
+
+// escapeString shows the escape character, like ~ or ^].
+func (f *escapeFilter) escapeString() string {
+	if f.char < 32 {
+		return "^" + string(f.char+'@')
+	}
+	return string(f.char)
+}
+
+// cooked restores the local terminal for the duration of fn.
+func (f *escapeFilter) cooked(fn func()) {
+	_ = terminal.Restore(f.fd, f.state)
+	fn()
+	_, _ = terminal.MakeRaw(f.fd)
+}
+
+func (f *escapeFilter) suspend() {
+	f.cooked(func() {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTSTP)
+	})
+	// the window may have been resized while suspended
+	sendWindowSize(f.session, f.fd)
+}
+
+func (f *escapeFilter) help() {
+	e := f.escapeString()
+	lines := []string{
+		"Supported escape sequences:",
+		" " + e + ".   - terminate connection",
+		" " + e + "C   - open a command line",
+		" " + e + "^Z  - suspend ssh",
+		" " + e + "#   - list forwarded connections",
+		" " + e + "?   - this message",
+		" " + e + e + "   - send the escape character by typing it twice",
+		"(Note that escapes are only recognized immediately after newline.)",
+	}
+	f.printf("%s\r\n", strings.Join(lines, "\r\n"))
+}
+
+func (f *escapeFilter) listForwards() {
+	lines := f.forwards.list()
+	if len(lines) == 0 {
+		f.printf("No forwarded connections.\r\n")
+		return
+	}
+	f.printf("The following forwardings are active:\r\n")
+	for _, line := range lines {
+		f.printf("  %s\r\n", line)
+	}
+}
+
+func (f *escapeFilter) commandLine() {
+	f.cooked(func() {
+		f.printf("\r\nssh> ")
+		line, err := f.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		err = f.command(strings.TrimSpace(line))
+		if err != nil {
+			f.printf("%s\n", err)
+		}
+	})
+}
+
+// command runs a command of the escape command line.
+func (f *escapeFilter) command(line string) error {
+	if line == "" {
+		return nil
+	}
+	fields := strings.Fields(line)
+	option := fields[0]
+	if option == "?" || option == "-h" {
+		f.printf("%s\n", strings.Join([]string{
+			"Commands:",
+			"      -L[bind_address:]port:host:hostport    Request local forward",
+			"      -R[bind_address:]port:host:hostport    Request remote forward",
+			"      -D[bind_address:]port                  Request dynamic forward",
+			"      -KL[bind_address:]port                 Cancel local forward",
+			"      -KR[bind_address:]port                 Cancel remote forward",
+			"      -KD[bind_address:]port                 Cancel dynamic forward",
+		}, "\n"))
+		return nil
+	}
+	cancel := strings.HasPrefix(option, "-K")
+	option = strings.TrimPrefix(strings.TrimPrefix(option, "-K"), "-")
+	if len(option) == 0 || !strings.ContainsRune("LRD", rune(option[0])) {
+		return fmt.Errorf("invalid command: %s", line)
+	}
+	kind := option[0]
+	spec := strings.TrimSpace(option[1:])
+	if spec == "" && len(fields) > 1 {
+		spec = fields[1]
+	}
+	if spec == "" {
+		return fmt.Errorf("missing forwarding specification: %s", line)
+	}
+	if cancel {
+		err := f.forwards.cancel(kind, spec)
+		if err == nil {
+			f.printf("Canceled forwarding.\n")
+		}
+		return err
+	}
+	f.printf("Forwarding port.\n")
+	return f.forwards.add(kind, spec)
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseEscapeChar(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+		err  bool
+	}{
+		{s: "~", want: '~'},
+		{s: "#", want: '#'},
+		{s: "^]", want: 0x1d},
+		{s: "^a", want: 1},
+		{s: "none", want: NoEscape},
+		{s: "", err: true},
+		{s: "ab", err: true},
+		{s: "^ab", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseEscapeChar(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseEscapeChar(%q): expected an error", test.s)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseEscapeChar(%q) = %d, %v, want %d", test.s, got, err, test.want)
+		}
+	}
+}
+
+type fakeConn struct {
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestEscapeFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		char  byte
+		input string
+		// want is what is sent to the server, when the connection is not
+		// closed by the escape sequence
+		want       string
+		disconnect bool
+	}{
+		{name: "no escape", char: '~', input: "ls -l\r", want: "ls -l\r"},
+		{name: "escape char mid-line", char: '~', input: "cd ~/src\r", want: "cd ~/src\r"},
+		{name: "double escape at start", char: '~', input: "~~", want: "~"},
+		{name: "double escape after CR", char: '~', input: "ls\r~~/x", want: "ls\r~/x"},
+		{name: "double escape after LF", char: '~', input: "ls\n~~", want: "ls\n~"},
+		{name: "double escape mid-line", char: '~', input: "a~~", want: "a~~"},
+		{name: "no escape after double escape", char: '~', input: "~~~.", want: "~~."},
+		{name: "unknown sequence", char: '~', input: "~x", want: "~x"},
+		{name: "escape then CR", char: '~', input: "~\r~~", want: "~\r~"},
+		{name: "disconnect mid-line", char: '~', input: "a~.", want: "a~."},
+		{name: "control escape char", char: 0x1d, input: "x\x1d\x1dy", want: "x\x1d\x1dy"},
+		{name: "disconnect at start", char: '~', input: "~.", disconnect: true},
+		{name: "disconnect after CR", char: '~', input: "ls\r~.ignored", disconnect: true},
+		{name: "disconnect after escape then CR", char: '~', input: "~\r~.", disconnect: true},
+		{name: "disconnect with control char", char: 0x1d, input: "\x1d.", disconnect: true},
+	}
+	for _, test := range tests {
+		conn := &fakeConn{}
+		f := &escapeFilter{
+			r:            bufio.NewReader(strings.NewReader(test.input)),
+			char:         test.char,
+			conn:         conn,
+			afterNewline: true,
+		}
+		got, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if f.Disconnected() != test.disconnect || conn.closed != test.disconnect {
+			t.Errorf("%s: disconnected = %v, closed = %v, want %v", test.name, f.Disconnected(), conn.closed, test.disconnect)
+			continue
+		}
+		if test.disconnect {
+			n, err := f.Read(make([]byte, 16))
+			if n != 0 || err != io.EOF {
+				t.Errorf("%s: read after disconnection = %d, %v", test.name, n, err)
+			}
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ExitStatus returns the exit status of vssh for the error of a SSH session,
+// like OpenSSH: the exit status of the remote command, or 255 if it was
+// killed by a signal, or for the connection and authentication errors. The
+// message is empty when the remote command just exited with a non-zero
+// status.
+func ExitStatus(err error) (int, string) {
+	switch e := err.(type) {
+	case nil:
+		return 0, ""
+	case *ssh.ExitError:
+		if e.Signal() == "" {
+			return e.ExitStatus(), ""
+		}
+		return 255, fmt.Sprintf("remote command killed by signal %s", e.Signal())
+	case *exec.ExitError:
+		// the native ssh client already exits like that. When ssh itself is
+		// killed, the status is the one of the shells.
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal()), ""
+		}
+		return e.ExitCode(), ""
+	default:
+		return 255, err.Error()
+	}
+}
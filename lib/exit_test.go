@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"os/exec"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// remoteExit runs a command on a fake SSH server. The server
+// ends the command with the request reqType, and returns the error of the
+// client session.
+func remoteExit(t *testing.T, reqType string, payload interface{}) error {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	// not net.Pipe: it is not buffered, and both ends send their version first
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(serverConn, config)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		go ssh.DiscardRequests(reqs)
+		for newChannel := range chans {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for req := range requests {
+					if req.Type != "exec" {
+						_ = req.Reply(false, nil)
+						continue
+					}
+					_ = req.Reply(true, nil)
+					_, _ = channel.SendRequest(reqType, false, ssh.Marshal(payload))
+					_ = channel.Close()
+				}
+			}()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session.Run("command")
+}
+
+func TestExitStatusRemote(t *testing.T) {
+	tests := []struct {
+		name    string
+		reqType string
+		payload interface{}
+		status  int
+		message bool
+	}{
+		{"success", "exit-status", struct{ Status uint32 }{0}, 0, false},
+		{"failure", "exit-status", struct{ Status uint32 }{3}, 3, false},
+		{"killed", "exit-signal", exitSignalMsg{Signal: "TERM"}, 255, true},
+		{"unknown signal", "exit-signal", exitSignalMsg{Signal: "XCPU"}, 255, true},
+	}
+	for _, test := range tests {
+		status, msg := ExitStatus(remoteExit(t, test.reqType, test.payload))
+		if status != test.status || (msg != "") != test.message {
+			t.Errorf("%s: got %d, %q", test.name, status, msg)
+		}
+	}
+}
+
+func TestExitStatusLocal(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		message string
+	}{
+		{"no error", nil, 0, ""},
+		{"connection error", errors.New("connection refused"), 255, "connection refused"},
+		{"native ssh failure", exec.Command("sh", "-c", "exit 4").Run(), 4, ""},
+		{"native ssh killed", exec.Command("sh", "-c", "kill -TERM $$").Run(), 128 + 15, ""},
+	}
+	for _, test := range tests {
+		status, msg := ExitStatus(test.err)
+		if status != test.status || msg != test.message {
+			t.Errorf("%s: got %d, %q, want %d, %q", test.name, status, msg, test.status, test.message)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/go-socks5"
+	"github.com/getlantern/golog"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// forward is a port forwarding added from the escape command line.
+type forward struct {
+	// kind is L, R or D, like the ssh option
+	kind     byte
+	listen   string
+	target   string
+	listener net.Listener
+	mu       sync.Mutex
+	conns    int
+}
+
+func (f *forward) String() string {
+	if f.kind == 'D' {
+		return fmt.Sprintf("-%c %s", f.kind, f.listen)
+	}
+	return fmt.Sprintf("-%c %s:%s", f.kind, f.listen, f.target)
+}
+
+func (f *forward) count(delta int) {
+	f.mu.Lock()
+	f.conns += delta
+	f.mu.Unlock()
+}
+
+// forwarder manages the port forwardings of a SSH connection.
+type forwarder struct {
+	conn     *ssh.Client
+	l        *zap.SugaredLogger
+	mu       sync.Mutex
+	forwards []*forward
+}
+
+func newForwarder(conn *ssh.Client, l *zap.SugaredLogger) *forwarder {
+	return &forwarder{conn: conn, l: l}
+}
+
+// splitForwardSpec splits a forwarding specification on colons. IPv6
+// addresses are enclosed in brackets.
+func splitForwardSpec(spec string) []string {
+	var fields []string
+	var current strings.Builder
+	brackets := false
+	for _, r := range spec {
+		switch {
+		case r == '[':
+			brackets = true
+		case r == ']':
+			brackets = false
+		case r == ':' && !brackets:
+			fields = append(fields, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(fields, current.String())
+}
+
+// parseListen parses [bind_address:]port. An empty bind address or "*"
+// listens on all interfaces.
+func parseListen(fields []string) (string, error) {
+	bind := "localhost"
+	switch len(fields) {
+	case 1:
+	case 2:
+		bind = fields[0]
+		if bind == "" || bind == "*" {
+			bind = "0.0.0.0"
+		}
+	default:
+		return "", errors.New("bad forwarding specification")
+	}
+	port, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || port < 0 || port > 65535 {
+		return "", fmt.Errorf("bad forwarding port: %s", fields[len(fields)-1])
+	}
+	return net.JoinHostPort(bind, strconv.Itoa(port)), nil
+}
+
+// parseForward parses a -L, -R or -D specification, and returns the listen
+// and the target addresses.
+func parseForward(kind byte, spec string) (listen, target string, err error) {
+	fields := splitForwardSpec(spec)
+	if kind == 'D' {
+		listen, err = parseListen(fields)
+		return listen, "", err
+	}
+	if len(fields) < 3 {
+		return "", "", errors.New("bad forwarding specification")
+	}
+	n := len(fields)
+	port, err := strconv.Atoi(fields[n-1])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", "", fmt.Errorf("bad forwarding port: %s", fields[n-1])
+	}
+	listen, err = parseListen(fields[:n-2])
+	if err != nil {
+		return "", "", err
+	}
+	return listen, net.JoinHostPort(fields[n-2], strconv.Itoa(port)), nil
+}
+
+// add starts a forwarding. -L and -D listen locally, -R listens on the
+// server.
+func (fw *forwarder) add(kind byte, spec string) error {
+	listen, target, err := parseForward(kind, spec)
+	if err != nil {
+		return err
+	}
+	f := &forward{kind: kind, listen: listen, target: target}
+	switch kind {
+	case 'L', 'D':
+		f.listener, err = net.Listen("tcp", listen)
+	case 'R':
+		f.listener, err = fw.conn.Listen("tcp", listen)
+	default:
+		return fmt.Errorf("unknown forwarding type: %c", kind)
+	}
+	if err != nil {
+		return fmt.Errorf("port forwarding failed: %s", err)
+	}
+	if bind, port, _ := net.SplitHostPort(listen); port == "0" {
+		// the port has been chosen by the system
+		if addr, ok := f.listener.Addr().(*net.TCPAddr); ok {
+			f.listen = net.JoinHostPort(bind, strconv.Itoa(addr.Port))
+		}
+	}
+	fw.mu.Lock()
+	fw.forwards = append(fw.forwards, f)
+	fw.mu.Unlock()
+	fw.l.Debugw("forwarding started", "forwarding", f.String())
+	go fw.serve(f)
+	return nil
+}
+
+// cancel stops the forwarding that listens on [bind_address:]port.
+func (fw *forwarder) cancel(kind byte, spec string) error {
+	listen, err := parseListen(splitForwardSpec(spec))
+	if err != nil {
+		return err
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for i, f := range fw.forwards {
+		if f.kind == kind && f.listen == listen {
+			fw.forwards = append(fw.forwards[:i], fw.forwards[i+1:]...)
+			_ = f.listener.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown port forwarding: -%c %s", kind, spec)
+}
+
+// list describes the active forwardings.
+func (fw *forwarder) list() []string {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	lines := make([]string, 0, len(fw.forwards))
+	for _, f := range fw.forwards {
+		f.mu.Lock()
+		lines = append(lines, fmt.Sprintf("%s (%d open connections)", f, f.conns))
+		f.mu.Unlock()
+	}
+	return lines
+}
+
+// closeAll stops all the forwardings.
+func (fw *forwarder) closeAll() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for _, f := range fw.forwards {
+		_ = f.listener.Close()
+	}
+	fw.forwards = nil
+}
+
+func (fw *forwarder) serve(f *forward) {
+	if f.kind == 'D' {
+		fw.serveSocks(f)
+		return
+	}
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			var other net.Conn
+			var err error
+			if f.kind == 'L' {
+				other, err = fw.conn.Dial("tcp", f.target)
+			} else {
+				other, err = net.Dial("tcp", f.target)
+			}
+			if err != nil {
+				fw.l.Warnw("forwarded connection failed", "forwarding", f.String(), "error", err)
+				_ = conn.Close()
+				return
+			}
+			f.count(1)
+			pipe(conn, other)
+			f.count(-1)
+		}()
+	}
+}
+
+// remoteResolver leaves the name resolution to the SSH server.
+type remoteResolver struct{}
+
+func (remoteResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+func (fw *forwarder) serveSocks(f *forward) {
+	golog.SetOutputs(ioutil.Discard, ioutil.Discard)
+	server, err := socks5.New(&socks5.Config{
+		Resolver: remoteResolver{},
+		Dial: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return fw.conn.Dial(network, addr)
+		},
+	})
+	if err != nil {
+		fw.l.Warnw("failed to start SOCKS server", "error", err)
+		_ = f.listener.Close()
+		return
+	}
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			f.count(1)
+			_ = server.ServeConn(conn)
+			f.count(-1)
+		}()
+	}
+}
+
+// pipe copies the data between a and b until both sides are done.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(a, b)
+		_ = a.Close()
+		close(done)
+	}()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+	<-done
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"8080", []string{"8080"}},
+		{"8080:web:80", []string{"8080", "web", "80"}},
+		{":8080:web:80", []string{"", "8080", "web", "80"}},
+		{"[::1]:8080", []string{"::1", "8080"}},
+		{"8080:[fd00::1]:80", []string{"8080", "fd00::1", "80"}},
+		{"[::1]:8080:[::1]:80", []string{"::1", "8080", "::1", "80"}},
+	}
+	for _, test := range tests {
+		if got := splitForwardSpec(test.spec); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitForwardSpec(%q) = %q, want %q", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		kind   byte
+		spec   string
+		listen string
+		target string
+		err    bool
+	}{
+		{kind: 'L', spec: "8080:web:80", listen: "localhost:8080", target: "web:80"},
+		{kind: 'L', spec: "127.0.0.1:8080:web:80", listen: "127.0.0.1:8080", target: "web:80"},
+		{kind: 'L', spec: "*:8080:web:80", listen: "0.0.0.0:8080", target: "web:80"},
+		{kind: 'L', spec: ":8080:web:80", listen: "0.0.0.0:8080", target: "web:80"},
+		{kind: 'L', spec: "0:web:80", listen: "localhost:0", target: "web:80"},
+		{kind: 'L', spec: "8080:[::1]:80", listen: "localhost:8080", target: "[::1]:80"},
+		{kind: 'L', spec: "[::1]:8080:[fd00::1]:80", listen: "[::1]:8080", target: "[fd00::1]:80"},
+		{kind: 'R', spec: "9090:localhost:3000", listen: "localhost:9090", target: "localhost:3000"},
+		{kind: 'R', spec: "[::]:9090:localhost:3000", listen: "[::]:9090", target: "localhost:3000"},
+		{kind: 'D', spec: "1080", listen: "localhost:1080"},
+		{kind: 'D', spec: "*:1080", listen: "0.0.0.0:1080"},
+		{kind: 'D', spec: "[::1]:1080", listen: "[::1]:1080"},
+		{kind: 'L', spec: "8080", err: true},
+		{kind: 'L', spec: "8080:web", err: true},
+		{kind: 'L', spec: "8080:web:0", err: true},
+		{kind: 'L', spec: "8080:web:http", err: true},
+		{kind: 'L', spec: "8080:web:65536", err: true},
+		{kind: 'L', spec: "http:web:80", err: true},
+		{kind: 'L', spec: "a:b:8080:web:80", err: true},
+		{kind: 'L', spec: "::1:8080:web:80", err: true},
+		{kind: 'D', spec: "a:b:1080", err: true},
+		{kind: 'D', spec: "65536", err: true},
+	}
+	for _, test := range tests {
+		listen, target, err := parseForward(test.kind, test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("-%c %s: expected an error, got %s %s", test.kind, test.spec, listen, target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-%c %s: unexpected error: %s", test.kind, test.spec, err)
+			continue
+		}
+		if listen != test.listen || target != test.target {
+			t.Errorf("-%c %s: got %s %s, want %s %s", test.kind, test.spec, listen, target, test.listen, test.target)
+		}
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
+	"github.com/stephane-martin/vssh/crypto"
 	"github.com/stephane-martin/vssh/params"
-	"github.com/stephane-martin/vssh/sys"
 
 	"github.com/awnumar/memguard"
 	gssh "github.com/stephane-martin/golang-ssh"
@@ -16,48 +17,59 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func GoConnectAuth(ctx context.Context, sshParams params.SSHParams, terminal bool, auth []ssh.AuthMethod, env map[string]string, l *zap.SugaredLogger) error {
-	if len(auth) == 0 {
-		return errors.New("no auth method")
-	}
-	cfg := gssh.Config{
-		User:      sshParams.LoginName,
-		Host:      sshParams.Host,
-		Port:      sshParams.Port,
-		Auth:      auth,
-		HTTPProxy: sshParams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, l)
+// GoConnectAuth connects to the server with the builtin client, and runs the
+// command or the login shell. env holds the secrets, given to the remote
+// command as mode tells. escape is the escape character of the interactive
+// sessions, or NoEscape.
+func GoConnectAuth(ctx context.Context, sshParams params.SSHParams, tty bool, mode SecretMode, escape int, auth []ssh.AuthMethod, env map[string]string, l *zap.SugaredLogger) error {
+	conn, err := Dial(ctx, sshParams, auth, l)
 	if err != nil {
 		return err
 	}
-	cfg.HostKey = hkcb
+	defer func() { _ = conn.Close() }()
 
-	var pre []string
+	command := strings.Join(sshParams.Commands, " ")
+	var stdin io.Reader = os.Stdin
+	var setenv map[string]string
 	if len(env) != 0 {
-		pre = append(pre, "env")
-		pre = append(pre, sys.EscapeEnv(env)...)
-		if len(sshParams.Commands) == 0 {
-			pre = append(pre, "bash")
+		switch mode {
+		case SecretSetenv:
+			setenv = env
+		case SecretFile:
+			var cleanup func()
+			command, cleanup, err = writeSecretFile(conn, env, command, l)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+		case SecretStdin:
+			if tty {
+				return errors.New("secrets can't be given on stdin with a pseudo-terminal")
+			}
+			stdin, command, err = secretScript(conn, env, command, l)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown secret mode: %s", mode)
 		}
 	}
-	commands := append(pre, sshParams.Commands...)
-	if len(sshParams.Commands) == 0 || terminal {
-		return gssh.Shell(ctx, cfg, os.Stdin, os.Stdout, os.Stderr, commands...)
+	if tty {
+		return shell(ctx, conn, command, setenv, escape, l)
 	}
-	err = gssh.OutputWithPty(ctx, cfg, strings.Join(commands, " "), os.Stdout, os.Stderr)
-	if err != nil {
+	err = execCommand(ctx, conn, command, stdin, setenv)
+	if _, ok := err.(*ssh.ExitError); err != nil && !ok {
 		return fmt.Errorf("failed to execute command: %s", err)
 	}
-	return nil
+	return err
 }
 
-func GoConnect(ctx context.Context, sshParams params.SSHParams, terminal bool, privkey, cert *memguard.LockedBuffer, env map[string]string, l *zap.SugaredLogger) error {
+func GoConnect(ctx context.Context, sshParams params.SSHParams, tty bool, mode SecretMode, escape int, privkey, cert *memguard.LockedBuffer, env map[string]string, l *zap.SugaredLogger) error {
 	c, err := gssh.ParseCertificate(cert.Buffer())
 	if err != nil {
 		return err
 	}
-	s, err := ssh.ParsePrivateKey(privkey.Buffer())
+	s, err := crypto.NewSealedSigner(privkey)
 	if err != nil {
 		return err
 	}
@@ -65,5 +77,5 @@ func GoConnect(ctx context.Context, sshParams params.SSHParams, terminal bool, p
 	if err != nil {
 		return err
 	}
-	return GoConnectAuth(ctx, sshParams, terminal, []ssh.AuthMethod{ssh.PublicKeys(signer)}, env, l)
+	return GoConnectAuth(ctx, sshParams, tty, mode, escape, []ssh.AuthMethod{ssh.PublicKeys(signer)}, env, l)
 }
@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/vault"
+
+	"github.com/mitchellh/go-homedir"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// readRevokedKeys reads a file of revoked keys, in the authorized_keys format.
+func readRevokedKeys(path string) (map[string]bool, error) {
+	revoked := make(map[string]bool)
+	if path == "" {
+		return revoked, nil
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return revoked, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revoked keys: %s", err)
+	}
+	for len(bytes.TrimSpace(content)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse revoked keys: %s", err)
+		}
+		revoked[string(key.Marshal())] = true
+		content = rest
+	}
+	return revoked, nil
+}
+
+// MakeHostKeyCallback returns a callback that verifies the host certificates
+// signed by the Vault host CA. The host keys that are not certified by the
+// Vault host CA are checked against known_hosts.
+func MakeHostKeyCallback(ctx context.Context, sshParams params.SSHParams, l *zap.SugaredLogger) (ssh.HostKeyCallback, error) {
+	acceptNew := !sshParams.Insecure && (sshParams.StrictHostKeyChecking == "accept-new" || sshParams.StrictHostKeyChecking == "no")
+	if acceptNew {
+		err := createKnownHosts()
+		if err != nil {
+			return nil, err
+		}
+	}
+	fallback, err := gssh.MakeHostKeyCallback(sshParams.Insecure, l)
+	if err != nil {
+		return nil, err
+	}
+	if sshParams.Insecure {
+		return fallback, nil
+	}
+	if acceptNew {
+		fallback = acceptNewHostKeys(fallback, l)
+	}
+	revoked, err := readRevokedKeys(sshParams.RevokedHostKeys)
+	if err != nil {
+		return nil, err
+	}
+	if sshParams.HostCAMount == "" && len(revoked) == 0 {
+		return fallback, nil
+	}
+
+	// the callback may be called concurrently, by the connections to the
+	// jump hosts and to the target
+	var hostCA ssh.PublicKey
+	var fetchOnce sync.Once
+	fetchHostCA := func() ssh.PublicKey {
+		fetchOnce.Do(func() {
+			if sshParams.HostCAMount == "" {
+				return
+			}
+			ca, err := vault.GetHostCA(ctx, sshParams.Vault, sshParams.HostCAMount, l)
+			if err != nil {
+				l.Warnw("host certificates can't be verified", "error", err)
+			}
+			hostCA = ca
+		})
+		return hostCA
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			ca := fetchHostCA()
+			return ca != nil && bytes.Equal(auth.Marshal(), ca.Marshal())
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return revoked[string(cert.Key.Marshal())] || revoked[string(cert.Marshal())]
+		},
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			if revoked[string(key.Marshal())] {
+				return fmt.Errorf("host key for %s is revoked", hostname)
+			}
+			return fallback(hostname, remote, key)
+		}
+		if revoked[string(cert.SignatureKey.Marshal())] {
+			return fmt.Errorf("host certificate authority for %s is revoked", hostname)
+		}
+		ca := fetchHostCA()
+		if ca == nil || !bytes.Equal(cert.SignatureKey.Marshal(), ca.Marshal()) {
+			// known_hosts may trust the certificate authority, or else the
+			// plain host key
+			err := fallback(hostname, remote, key)
+			if err != nil && fallback(hostname, remote, cert.Key) == nil {
+				return nil
+			}
+			return err
+		}
+		err := checker.CheckHostKey(hostname, remote, key)
+		if err != nil {
+			return fmt.Errorf("host certificate verification failed: %s", err)
+		}
+		l.Debugw("host certificate verified", "hostname", hostname, "key_id", cert.KeyId)
+		return nil
+	}, nil
+}
+
+// knownHostsFile is the known_hosts file that gssh.MakeHostKeyCallback reads.
+const knownHostsFile = "~/.ssh/known_hosts"
+
+func createKnownHosts() error {
+	path, err := homedir.Expand(knownHostsFile)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create known_hosts file: %s", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create known_hosts file: %s", err)
+	}
+	return f.Close()
+}
+
+// acceptNewHostKeys implements StrictHostKeyChecking=accept-new: the keys of
+// the hosts that are not in known_hosts are added to it. The changed host keys
+// are still rejected.
+func acceptNewHostKeys(callback ssh.HostKeyCallback, l *zap.SugaredLogger) ssh.HostKeyCallback {
+	// each auth method is tried with a new connection, but known_hosts is
+	// only read once
+	var mu sync.Mutex
+	added := make(map[string]bool)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+		line := knownhosts.Line([]string{hostname}, key)
+		if added[line] {
+			return nil
+		}
+		err := callback(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) != 0 {
+			return err
+		}
+		if _, ok := key.(*ssh.Certificate); ok {
+			// the caller checks the plain host key next
+			return err
+		}
+		path, err := homedir.Expand(knownHostsFile)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to add host key to known_hosts: %s", err)
+		}
+		_, err = fmt.Fprintln(f, line)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to add host key to known_hosts: %s", err)
+		}
+		added[line] = true
+		l.Warnw("permanently added the host key to known_hosts", "hostname", hostname, "fingerprint", ssh.FingerprintSHA256(key))
+		return nil
+	}
+}
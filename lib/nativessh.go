@@ -3,39 +3,28 @@ package lib
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"github.com/stephane-martin/vssh/crypto"
-	"github.com/stephane-martin/vssh/params"
-	"github.com/stephane-martin/vssh/sys"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+	"github.com/stephane-martin/vssh/vault"
 
 	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
 )
 
-func writePubkey(dir string, pub *crypto.PublicKey) (string, error) {
-	pubkeyPath := filepath.Join(dir, "key.pub")
-	serialized, err := crypto.SerializePublicKey(pub)
-	if err != nil {
-		return pubkeyPath, err
-	}
-	return pubkeyPath, writeKey(pubkeyPath, serialized)
-}
-
-func writePrivkey(dir string, priv *memguard.LockedBuffer) (string, error) {
-	privkeyPath := filepath.Join(dir, "key")
-	return privkeyPath, writeKey(privkeyPath, priv)
-}
-
-func writeCert(dir string, cert *memguard.LockedBuffer) (string, error) {
-	certPath := filepath.Join(dir, "key-cert.pub")
-	return certPath, writeKey(certPath, cert)
-}
-
 func writeKey(path string, key *memguard.LockedBuffer) error {
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
@@ -50,72 +39,367 @@ func writeKey(path string, key *memguard.LockedBuffer) error {
 	return err
 }
 
-func NativeConnect(ctx context.Context, sshParams params.SSHParams, terminal, verbose bool, priv *memguard.LockedBuffer, pub *crypto.PublicKey, cert *memguard.LockedBuffer, env map[string]string, l *zap.SugaredLogger) error {
-	dir, err := ioutil.TempDir("", "vssh")
+// quote quotes a ssh_config argument.
+func quote(s string) string {
+	return `"` + s + `"`
+}
+
+// nativeOptions holds the ssh_config options for a host, in the order they
+// are given.
+type nativeOptions [][2]string
+
+func (o *nativeOptions) add(name, value string) {
+	*o = append(*o, [2]string{name, value})
+}
+
+// args returns the options as command line arguments.
+func (o nativeOptions) args() []string {
+	args := make([]string, 0, 2*len(o))
+	for _, opt := range o {
+		args = append(args, "-o", opt[0]+"="+opt[1])
+	}
+	return args
+}
+
+// writeCredentials writes the keys and certificates to dir, and returns the
+// options so that ssh uses them. The password, if any, is returned too, as
+// ssh can only read it from SSH_ASKPASS. The ephemeral private keys are not
+// written: ssh gets them from the agent at agentSocket.
+func writeCredentials(dir, prefix string, credentials []crypto.SSHCredentials, agentSocket string) (opts nativeOptions, password *memguard.LockedBuffer, err error) {
+	agent := false
+	ephemeral := false
+	for i, credential := range credentials {
+		base := filepath.Join(dir, fmt.Sprintf("%s-%d", prefix, i))
+		switch {
+		case credential.PrivateKey != nil && credential.Ephemeral:
+			if agentSocket == "" {
+				return nil, nil, errors.New("no agent for the ephemeral private key")
+			}
+			// the public key is written below
+			opts.add("IdentityFile", quote(base+".pub"))
+			ephemeral = true
+		case credential.PrivateKey != nil:
+			err = writeKey(base, credential.PrivateKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts.add("IdentityFile", quote(base))
+		case credential.AgentSigner != nil && credential.Certificate != nil:
+			// the private key stays in the agent
+			pubkey := ssh.MarshalAuthorizedKey(credential.AgentSigner.PublicKey())
+			err = ioutil.WriteFile(base+".pub", pubkey, 0600)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts.add("IdentityFile", quote(base+".pub"))
+			agent = true
+		case credential.Password != nil:
+			password = credential.Password
+			continue
+		case credential.Agent:
+			agent = true
+			continue
+		default:
+			continue
+		}
+		if credential.PublicKey != nil {
+			pubkey, err := crypto.SerializePublicKey(credential.PublicKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = writeKey(base+".pub", pubkey)
+			pubkey.Destroy()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if credential.Certificate != nil {
+			err = writeKey(base+"-cert.pub", credential.Certificate)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts.add("CertificateFile", quote(base+"-cert.pub"))
+		}
+	}
+	opts.add("IdentitiesOnly", "yes")
+	if ephemeral {
+		opts.add("IdentityAgent", quote(agentSocket))
+	} else if !agent {
+		opts.add("IdentityAgent", "none")
+	}
+	opts.add("AddKeysToAgent", "no")
+	return opts, password, nil
+}
+
+// hostKeyOptions returns the options to check the host key of the server.
+// The host certificate authority from Vault is written to a known_hosts
+// file.
+func hostKeyOptions(ctx context.Context, dir string, sshParams params.SSHParams, l *zap.SugaredLogger) (opts nativeOptions, err error) {
+	if sshParams.Insecure {
+		opts.add("StrictHostKeyChecking", "no")
+		opts.add("UserKnownHostsFile", "/dev/null")
+		return opts, nil
+	}
+	if sshParams.HostCAMount != "" {
+		ca, err := vault.GetHostCA(ctx, sshParams.Vault, sshParams.HostCAMount, l)
+		if err != nil {
+			l.Warnw("host certificates can't be verified", "error", err)
+		} else {
+			path := filepath.Join(dir, "known_hosts")
+			line := "@cert-authority * " + string(ssh.MarshalAuthorizedKey(ca))
+			err = ioutil.WriteFile(path, []byte(line), 0600)
+			if err != nil {
+				return nil, err
+			}
+			opts.add("UserKnownHostsFile", "~/.ssh/known_hosts ~/.ssh/known_hosts2 "+quote(path))
+		}
+	}
+	if sshParams.RevokedHostKeys != "" {
+		path, err := homedir.Expand(sshParams.RevokedHostKeys)
+		if err != nil {
+			return nil, err
+		}
+		opts.add("RevokedHostKeys", quote(path))
+	}
+	return opts, nil
+}
+
+// writeJumpConfig writes a ssh_config file with the options and credentials
+// of each jump host. ssh passes the configuration file to the ssh processes
+// it runs for the jump hosts. The user configuration is included at the end,
+// so that the other options still apply.
+func writeJumpConfig(ctx context.Context, dir string, sshParams params.SSHParams, jumps []crypto.JumpCredentials, agentSocket string, l *zap.SugaredLogger) (path string, aliases []string, err error) {
+	var b bytes.Buffer
+	b.WriteString("# generated by vssh\n")
+	for i, jump := range jumps {
+		alias := fmt.Sprintf("vssh-jump-%d", i)
+		aliases = append(aliases, alias)
+		opts := nativeOptions{
+			{"HostName", jump.Params.Host},
+			{"User", quote(jump.Params.LoginName)},
+			{"Port", strconv.Itoa(sshPort(jump.Params))},
+			{"ProxyJump", "none"},
+		}
+		creds, password, err := writeCredentials(dir, alias, jump.Credentials, agentSocket)
+		if err != nil {
+			return "", nil, err
+		}
+		if password != nil {
+			l.Warnw("passwords are not supported for the jump hosts with --native", "host", jump.Params.Host)
+		}
+		opts = append(opts, creds...)
+		hostKey, err := hostKeyOptions(ctx, dir, jump.Params, l)
+		if err != nil {
+			return "", nil, err
+		}
+		opts = append(opts, hostKey...)
+		fmt.Fprintf(&b, "\nHost %s\n", alias)
+		for _, opt := range opts {
+			fmt.Fprintf(&b, "    %s %s\n", opt[0], opt[1])
+		}
+	}
+	b.WriteString("\nMatch all\n")
+	switch strings.ToLower(sshParams.SSHConfigFile) {
+	case "":
+		fmt.Fprintf(&b, "Include %s\n", params.DefaultSSHConfigFile)
+		fmt.Fprintf(&b, "Include %s\n", params.SystemSSHConfigFile)
+	case "none":
+	default:
+		userConfig, err := homedir.Expand(sshParams.SSHConfigFile)
+		if err != nil {
+			return "", nil, err
+		}
+		userConfig, err = filepath.Abs(userConfig)
+		if err != nil {
+			return "", nil, err
+		}
+		fmt.Fprintf(&b, "Include %s\n", quote(userConfig))
+	}
+	path = filepath.Join(dir, "ssh_config")
+	return path, aliases, ioutil.WriteFile(path, b.Bytes(), 0600)
+}
+
+// ephemeralAgent serves the ephemeral private keys to ssh, with an agent
+// listening in dir, so that they are never written to disk. The socket is
+// empty when there is no ephemeral private key. stop must be called when ssh
+// has exited.
+func ephemeralAgent(ctx context.Context, dir string, credentials []crypto.SSHCredentials, jumps []crypto.JumpCredentials, l *zap.SugaredLogger) (socket string, stop func(), err error) {
+	var ephemeral []crypto.SSHCredentials
+	for _, credential := range credentials {
+		if credential.Ephemeral {
+			ephemeral = append(ephemeral, credential)
+		}
+	}
+	for _, jump := range jumps {
+		for _, credential := range jump.Credentials {
+			if credential.Ephemeral {
+				ephemeral = append(ephemeral, credential)
+			}
+		}
+	}
+	if len(ephemeral) == 0 {
+		return "", func() {}, nil
+	}
+	socket = filepath.Join(dir, "agent")
+	listener, err := ListenAgent(socket)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary directory: %s", err)
+		return "", nil, err
 	}
-	l.Debugw("using temp directory", "dirname", dir)
-	defer func() { _ = os.RemoveAll(dir) }()
+	// the certificates are not renewed, the agent does not need Vault
+	a := NewVaultAgent(ephemeral, "", params.VaultParams{}, crypto.SignOptions{}, nil, l)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = a.Serve(ctx, listener)
+	}()
+	return socket, func() {
+		cancel()
+		<-done
+	}, nil
+}
 
-	pubkeyPath, err := writePubkey(dir, pub)
-	defer func() { _ = os.Remove(pubkeyPath) }()
+// askPass writes a SSH_ASKPASS program that gives the password to ssh. The
+// password goes through a named pipe, so that it is never written to disk:
+// ssh closes the inherited file descriptors before it runs SSH_ASKPASS, so an
+// anonymous pipe can't be used. The password is given once, then the pipe is
+// removed: if ssh asks again, the askpass program fails. stop must be called
+// when ssh has exited.
+func askPass(dir string, password *memguard.LockedBuffer) (env []string, stop func(), err error) {
+	fifo := filepath.Join(dir, "password")
+	err = syscall.Mkfifo(fifo, 0600)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	privkeyPath, err := writePrivkey(dir, priv)
-	defer func() { _ = os.Remove(privkeyPath) }()
+	askPassPath := filepath.Join(dir, "askpass")
+	script := "#!/bin/sh\nexec cat " + sys.EscapeString(fifo) + "\n"
+	err = ioutil.WriteFile(askPassPath, []byte(script), 0700)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	var stopping int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// blocks until the askpass program opens the pipe
+		f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err == nil {
+			if atomic.LoadInt32(&stopping) == 0 {
+				_, _ = f.Write(password.Buffer())
+			}
+			_ = f.Close()
+		}
+		_ = os.Remove(fifo)
+	}()
+	stop = func() {
+		atomic.StoreInt32(&stopping, 1)
+		// opening the pipe releases the writer, if ssh did not ask
+		r, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			defer func() { _ = r.Close() }()
+		} else if !os.IsNotExist(err) {
+			return
+		}
+		<-done
+	}
+	return []string{
+		"SSH_ASKPASS=" + askPassPath,
+		"SSH_ASKPASS_REQUIRE=force",
+	}, stop, nil
+}
+
+// NativeConnect runs the ssh binary to connect to the server. The keys and
+// certificates are written to a temporary directory, removed when ssh
+// exits, except the ephemeral private keys that ssh gets from an agent. options are the extra -o options for ssh, and escape is given to
+// ssh with -e. The secrets in env are
+// sent with SendEnv. When the remote command fails, the *exec.ExitError of
+// ssh is returned. Like ssh, it ignores the ALL_PROXY environment variable,
+// but an explicit --proxy is an error.
+func NativeConnect(ctx context.Context, sshParams params.SSHParams, tty, verbose bool, escape string, options []string, credentials []crypto.SSHCredentials, jumps []crypto.JumpCredentials, mode SecretMode, env map[string]string, l *zap.SugaredLogger) error {
+	if sshParams.Proxy != nil {
+		if !sshParams.ProxyFromEnv {
+			return errors.New("--proxy is not supported with --native, use ProxyCommand in ssh_config")
+		}
+		l.Debugw("ALL_PROXY is ignored with --native", "proxy", sshParams.Proxy.Host)
+	}
+	if len(env) != 0 && mode != SecretSetenv {
+		return fmt.Errorf("secret mode %s is not supported with --native", mode)
 	}
-	certPath, err := writeCert(dir, cert)
-	defer func() { _ = os.Remove(certPath) }()
+	dir, err := ioutil.TempDir("", "vssh")
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create temporary directory: %s", err)
 	}
+	l.Debugw("using temp directory", "dirname", dir)
+	defer func() { _ = os.RemoveAll(dir) }()
 
 	var allArgs []string
 	if verbose {
 		allArgs = append(allArgs, "-v")
 	}
-	if terminal {
+	if tty {
 		allArgs = append(allArgs, "-t")
+	} else {
+		allArgs = append(allArgs, "-T")
+	}
+	if escape != "" {
+		allArgs = append(allArgs, "-e", escape)
+	}
+	agentSocket, stopAgent, err := ephemeralAgent(ctx, dir, credentials, jumps, l)
+	if err != nil {
+		return fmt.Errorf("failed to start the agent for the ephemeral keys: %s", err)
+	}
+	defer stopAgent()
+	if len(jumps) > 0 {
+		configPath, aliases, err := writeJumpConfig(ctx, dir, sshParams, jumps, agentSocket, l)
+		if err != nil {
+			return fmt.Errorf("failed to write ssh_config for the jump hosts: %s", err)
+		}
+		allArgs = append(allArgs, "-F", configPath, "-J", strings.Join(aliases, ","))
+	} else if sshParams.SSHConfigFile != "" {
+		allArgs = append(allArgs, "-F", sshParams.SSHConfigFile)
+	}
+	for _, option := range options {
+		allArgs = append(allArgs, "-o", option)
 	}
 
-	if sshParams.Insecure {
-		allArgs = append(
-			allArgs,
-			"-o", "StrictHostKeyChecking=no",
-			"-o", "UserKnownHostsFile=/dev/null",
-		)
+	opts, password, err := writeCredentials(dir, "key", credentials, agentSocket)
+	if err != nil {
+		return fmt.Errorf("failed to write credentials: %s", err)
+	}
+	hostKey, err := hostKeyOptions(ctx, dir, sshParams, l)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, hostKey...)
+	opts.add("HostName", sshParams.Host)
+	opts.add("ForwardAgent", "no")
+	for k := range env {
+		opts.add("SendEnv", k)
 	}
+	allArgs = append(allArgs, opts.args()...)
 	allArgs = append(
 		allArgs,
-		"-o", fmt.Sprintf("IdentityFile=%s", privkeyPath),
-		"-o", fmt.Sprintf("CertificateFile=%s", certPath),
-		"-o", "IdentitiesOnly=yes",
-		"-o", "IdentityAgent=none",
-		"-o", "AddKeysToAgent=no",
-		"-o", "ForwardAgent=no",
 		"-l", strings.Replace(sshParams.LoginName, " ", `\ `, -1),
-		"-p", fmt.Sprintf("%d", sshParams.Port),
-		sshParams.Host,
+		"-p", strconv.Itoa(sshPort(sshParams)),
+		sshParams.HostAlias,
 	)
-	if len(env) != 0 {
-		var pre []string
-		pre = append(pre, "env")
-		pre = append(pre, sys.EscapeEnv(env)...)
-		if len(sshParams.Commands) == 0 {
-			pre = append([]string{"-t"}, pre...)
-			pre = append(pre, "bash")
-		}
-		allArgs = append(allArgs, pre...)
-	}
 	allArgs = append(allArgs, sshParams.Commands...)
 
 	cmd := exec.CommandContext(ctx, "ssh", allArgs...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if password != nil {
+		askPassEnv, stop, err := askPass(dir, password)
+		if err != nil {
+			return fmt.Errorf("failed to write credentials: %s", err)
+		}
+		defer stop()
+		cmd.Env = append(cmd.Env, askPassEnv...)
+	}
 	return cmd.Run()
 }
@@ -0,0 +1,400 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/vault"
+
+	"go.uber.org/zap"
+)
+
+// proxyDialer returns the function that dials the first SSH server, at
+// host:port. The proxy type is given by the scheme of the proxy URL. The
+// proxy is not used for the hosts that match NO_PROXY.
+func proxyDialer(ctx context.Context, sshParams params.SSHParams, host string, port int, l *zap.SugaredLogger) (dialFunc, error) {
+	var d net.Dialer
+	u := sshParams.Proxy
+	if u == nil || matchNoProxy(sshParams.NoProxy, host, port) {
+		return d.DialContext, nil
+	}
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	} else if sshParams.ProxySecret != "" {
+		var err error
+		username, password, err = readProxyCredentials(ctx, sshParams, l)
+		if err != nil {
+			return nil, fmt.Errorf("can't read proxy credentials from vault: %s", err)
+		}
+	}
+	scheme := strings.ToLower(u.Scheme)
+	l.Debugw("connecting through proxy", "scheme", scheme, "proxy", u.Host)
+	switch scheme {
+	case "http", "https":
+		p := httpConnectProxy{
+			addr:     proxyAddr(u, map[string]string{"http": "80", "https": "443"}[scheme]),
+			https:    scheme == "https",
+			username: username,
+			password: password,
+		}
+		return p.DialContext, nil
+	case "socks5", "socks5h":
+		p := socks5Proxy{
+			addr:          proxyAddr(u, "1080"),
+			remoteResolve: scheme == "socks5h",
+			username:      username,
+			password:      password,
+		}
+		return p.DialContext, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+}
+
+// proxyCredentials holds the proxy credentials read from Vault, so that Vault
+// is asked only once when several connections are made, like with scp or
+// sftp.
+var proxyCredentials = struct {
+	sync.Mutex
+	bySecret map[string][2]string
+}{bySecret: make(map[string][2]string)}
+
+// readProxyCredentials returns the username and password fields of the
+// --proxy-secret Vault secret.
+func readProxyCredentials(ctx context.Context, sshParams params.SSHParams, l *zap.SugaredLogger) (username, password string, err error) {
+	key := strings.Join([]string{
+		vault.NormalizeAddress(sshParams.Vault.Address), sshParams.Vault.Namespace, sshParams.ProxySecret,
+	}, "\x00")
+	proxyCredentials.Lock()
+	defer proxyCredentials.Unlock()
+	if creds, ok := proxyCredentials.bySecret[key]; ok {
+		return creds[0], creds[1], nil
+	}
+	client, err := vault.GetVaultClient(ctx, sshParams.Vault, l)
+	if err != nil {
+		return "", "", err
+	}
+	username, password, err = vault.ReadCredentialsFromVault(ctx, sshParams.ProxySecret, client, l)
+	if err != nil {
+		return "", "", err
+	}
+	proxyCredentials.bySecret[key] = [2]string{username, password}
+	return username, password, nil
+}
+
+func proxyAddr(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// matchNoProxy tells if the host matches the NO_PROXY list. The entries are
+// domain names, that match their subdomains too, IP addresses or CIDR
+// blocks, with an optional port. "*" matches every host.
+func matchNoProxy(noProxy, host string, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != strconv.Itoa(port) {
+				continue
+			}
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+		if _, block, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && block.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeOnDone closes conn if ctx is canceled before the returned function is
+// called. It makes the proxy handshakes cancelable.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// httpConnectProxy dials through a HTTP proxy with the CONNECT method, with
+// optional Basic authentication.
+type httpConnectProxy struct {
+	addr     string
+	https    bool
+	username string
+	password string
+}
+
+func (p httpConnectProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %s", err)
+	}
+	stop := closeOnDone(ctx, conn)
+	c, err := p.connect(conn, addr)
+	stop()
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p httpConnectProxy) connect(conn net.Conn, addr string) (net.Conn, error) {
+	if p.https {
+		host, _, _ := net.SplitHostPort(p.addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		err := tlsConn.Handshake()
+		if err != nil {
+			return nil, fmt.Errorf("TLS handshake with proxy failed: %s", err)
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	req.Header.Set("User-Agent", "vssh")
+	if p.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to proxy: %s", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy response: %s", err)
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		return nil, errors.New("proxy authentication required")
+	default:
+		return nil, fmt.Errorf("proxy error: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// the SSH server may have sent its banner with the proxy response
+		return bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// socks5Proxy dials through a SOCKS5 proxy (RFC 1928), with optional
+// username/password authentication (RFC 1929). With socks5h, the host names
+// are resolved by the proxy.
+type socks5Proxy struct {
+	addr          string
+	remoteResolve bool
+	username      string
+	password      string
+}
+
+var socks5Errors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (p socks5Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+	if !p.remoteResolve && net.ParseIP(host) == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		host = addrs[0].IP.String()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %s", err)
+	}
+	stop := closeOnDone(ctx, conn)
+	err = p.connect(conn, host, port)
+	stop()
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p socks5Proxy) connect(conn net.Conn, host string, port int) error {
+	methods := []byte{0}
+	if p.username != "" {
+		methods = []byte{2}
+	}
+	_, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...))
+	if err != nil {
+		return fmt.Errorf("failed to write to proxy: %s", err)
+	}
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return fmt.Errorf("failed to read proxy response: %s", err)
+	}
+	if buf[0] != 5 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	switch buf[1] {
+	case 0:
+	case 2:
+		if len(p.username) > 255 || len(p.password) > 255 {
+			return errors.New("proxy username or password too long")
+		}
+		req := []byte{1, byte(len(p.username))}
+		req = append(req, p.username...)
+		req = append(req, byte(len(p.password)))
+		req = append(req, p.password...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return fmt.Errorf("failed to write to proxy: %s", err)
+		}
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return fmt.Errorf("failed to read proxy response: %s", err)
+		}
+		if buf[1] != 0 {
+			return errors.New("proxy authentication failed")
+		}
+	case 0xff:
+		if p.username == "" {
+			return errors.New("proxy authentication required")
+		}
+		return errors.New("no acceptable proxy authentication method")
+	default:
+		return fmt.Errorf("unsupported proxy authentication method: %d", buf[1])
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return fmt.Errorf("failed to write to proxy: %s", err)
+	}
+
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return fmt.Errorf("failed to read proxy response: %s", err)
+	}
+	if reply[1] != 0 {
+		if msg, ok := socks5Errors[reply[1]]; ok {
+			return fmt.Errorf("proxy error: %s", msg)
+		}
+		return fmt.Errorf("proxy error: code %d", reply[1])
+	}
+	// skip the bound address
+	var skip int
+	switch reply[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err != nil {
+			return fmt.Errorf("failed to read proxy response: %s", err)
+		}
+		skip = int(buf[0]) + 2
+	default:
+		return fmt.Errorf("invalid proxy response")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	if err != nil {
+		return fmt.Errorf("failed to read proxy response: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMatchNoProxy(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		host    string
+		port    int
+		want    bool
+	}{
+		{"", "example.org", 22, false},
+		{"*", "example.org", 22, true},
+		{"example.org", "example.org", 22, true},
+		{"example.org", "EXAMPLE.ORG.", 22, true},
+		{"example.org", "web.example.org", 22, true},
+		{"example.org", "badexample.org", 22, false},
+		{".example.org", "web.example.org", 22, true},
+		{".example.org", "example.org", 22, true},
+		{"*.example.org", "web.example.org", 22, true},
+		{"other.org, example.org", "web.example.org", 22, true},
+		{"other.org,,", "web.example.org", 22, false},
+		{"example.org:22", "example.org", 22, true},
+		{"example.org:2222", "example.org", 22, false},
+		{"10.0.0.1", "10.0.0.1", 22, true},
+		{"10.0.0.1", "10.0.0.2", 22, false},
+		{"10.0.0.0/8", "10.1.2.3", 22, true},
+		{"10.0.0.0/8", "192.168.1.1", 22, false},
+		{"10.0.0.0/8", "web.example.org", 22, false},
+		{"::1", "::1", 22, true},
+		{"[::1]:22", "::1", 22, true},
+		{"[::1]:22", "::1", 2222, false},
+		{"fd00::/8", "fd12::1", 22, true},
+		{"localhost", "127.0.0.1", 22, false},
+	}
+	for _, test := range tests {
+		got := matchNoProxy(test.noProxy, test.host, test.port)
+		if got != test.want {
+			t.Errorf("matchNoProxy(%q, %q, %d) = %v, want %v", test.noProxy, test.host, test.port, got, test.want)
+		}
+	}
+}
+
+// socks5Request is what the fake SOCKS5 server received.
+type socks5Request struct {
+	methods  []byte
+	username string
+	password string
+	host     string
+	port     int
+}
+
+// fakeSocks5Server serves one SOCKS5 CONNECT on conn. It accepts the
+// username/password authentication if it is offered, and answers the CONNECT
+// with reply, and a bound address of type atyp.
+func fakeSocks5Server(conn net.Conn, acceptAuth bool, reply byte, atyp byte) (socks5Request, error) {
+	var req socks5Request
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return req, err
+	}
+	if buf[0] != 5 {
+		return req, fmt.Errorf("bad version %d", buf[0])
+	}
+	req.methods = make([]byte, buf[1])
+	if _, err := io.ReadFull(r, req.methods); err != nil {
+		return req, err
+	}
+	method := byte(0xff)
+	for _, m := range req.methods {
+		if m == 2 || (m == 0 && !acceptAuth) {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{5, method}); err != nil {
+		return req, err
+	}
+	switch method {
+	case 0xff:
+		return req, nil
+	case 2:
+		readString := func() (string, error) {
+			n, err := r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			s := make([]byte, n)
+			_, err = io.ReadFull(r, s)
+			return string(s), err
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return req, err
+		}
+		var err error
+		if req.username, err = readString(); err != nil {
+			return req, err
+		}
+		if req.password, err = readString(); err != nil {
+			return req, err
+		}
+		status := byte(0)
+		if !acceptAuth {
+			status = 1
+		}
+		if _, err := conn.Write([]byte{1, status}); err != nil {
+			return req, err
+		}
+		if status != 0 {
+			return req, nil
+		}
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return req, err
+	}
+	if head[0] != 5 || head[1] != 1 {
+		return req, fmt.Errorf("bad request %v", head)
+	}
+	switch head[3] {
+	case 1, 4:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == 4 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return req, err
+		}
+		req.host = ip.String()
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return req, err
+		}
+		host := make([]byte, n)
+		if _, err := io.ReadFull(r, host); err != nil {
+			return req, err
+		}
+		req.host = string(host)
+	default:
+		return req, fmt.Errorf("bad address type %d", head[3])
+	}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return req, err
+	}
+	req.port = int(binary.BigEndian.Uint16(buf))
+
+	resp := []byte{5, reply, 0, atyp}
+	switch atyp {
+	case 1:
+		resp = append(resp, 127, 0, 0, 1)
+	case 4:
+		resp = append(resp, net.IPv6loopback...)
+	case 3:
+		resp = append(resp, 9)
+		resp = append(resp, "localhost"...)
+	}
+	resp = append(resp, 0x1f, 0x90)
+	// the client stops reading after an error reply
+	_, _ = conn.Write(resp)
+	return req, nil
+}
+
+func TestSocks5Connect(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxy      socks5Proxy
+		host       string
+		acceptAuth bool
+		reply      byte
+		atyp       byte
+		want       socks5Request
+		err        string
+	}{
+		{
+			name: "host name without authentication",
+			host: "web.example.org",
+			atyp: 1,
+			want: socks5Request{methods: []byte{0}, host: "web.example.org", port: 22},
+		},
+		{
+			name: "IPv4 address",
+			host: "10.0.0.1",
+			atyp: 4,
+			want: socks5Request{methods: []byte{0}, host: "10.0.0.1", port: 22},
+		},
+		{
+			name: "IPv6 address",
+			host: "fd00::1",
+			atyp: 3,
+			want: socks5Request{methods: []byte{0}, host: "fd00::1", port: 22},
+		},
+		{
+			name:       "username and password",
+			proxy:      socks5Proxy{username: "alice", password: "pw"},
+			host:       "web.example.org",
+			acceptAuth: true,
+			atyp:       1,
+			want:       socks5Request{methods: []byte{2}, username: "alice", password: "pw", host: "web.example.org", port: 22},
+		},
+		{
+			name:  "wrong password",
+			proxy: socks5Proxy{username: "alice", password: "wrong"},
+			host:  "web.example.org",
+			err:   "proxy authentication failed",
+		},
+		{
+			name:       "authentication required",
+			host:       "web.example.org",
+			acceptAuth: true,
+			err:        "proxy authentication required",
+		},
+		{
+			name:  "connection refused",
+			host:  "web.example.org",
+			reply: 5,
+			atyp:  1,
+			err:   "proxy error: connection refused",
+		},
+		{
+			name:  "unknown error",
+			host:  "web.example.org",
+			reply: 42,
+			atyp:  1,
+			err:   "proxy error: code 42",
+		},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		done := make(chan socks5Request, 1)
+		go func() {
+			req, err := fakeSocks5Server(server, test.acceptAuth, test.reply, test.atyp)
+			if err != nil {
+				t.Errorf("%s: fake server: %s", test.name, err)
+			}
+			done <- req
+		}()
+		err := test.proxy.connect(client, test.host, 22)
+		_ = client.Close()
+		req := <-done
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if fmt.Sprint(req) != fmt.Sprint(test.want) {
+			t.Errorf("%s: the proxy got %+v, want %+v", test.name, req, test.want)
+		}
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		proxy  httpConnectProxy
+		status int
+		auth   string
+		err    string
+	}{
+		{name: "without authentication", status: http.StatusOK},
+		{name: "basic authentication", proxy: httpConnectProxy{username: "alice", password: "pw"}, status: http.StatusOK, auth: "Basic YWxpY2U6cHc="},
+		{name: "authentication required", status: http.StatusProxyAuthRequired, err: "proxy authentication required"},
+		{name: "forbidden", status: http.StatusForbidden, err: "proxy error: 403 Forbidden"},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		done := make(chan *http.Request, 1)
+		go func() {
+			defer func() { _ = server.Close() }()
+			req, err := http.ReadRequest(bufio.NewReader(server))
+			if err != nil {
+				t.Errorf("%s: fake proxy: %s", test.name, err)
+				done <- nil
+				return
+			}
+			done <- req
+			// the SSH server sends its banner right after the proxy response
+			_, _ = fmt.Fprintf(server, "HTTP/1.1 %d %s\r\n\r\nSSH-2.0-test\r\n", test.status, http.StatusText(test.status))
+		}()
+		conn, err := test.proxy.connect(client, "web.example.org:22")
+		req := <-done
+		if req != nil {
+			if req.Method != "CONNECT" || req.Host != "web.example.org:22" {
+				t.Errorf("%s: the proxy got %s %s", test.name, req.Method, req.Host)
+			}
+			if got := req.Header.Get("Proxy-Authorization"); got != test.auth {
+				t.Errorf("%s: got Proxy-Authorization %q, want %q", test.name, got, test.auth)
+			}
+		}
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			_ = client.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			_ = client.Close()
+			continue
+		}
+		banner, err := ioutil.ReadAll(conn)
+		if err != nil || !strings.HasPrefix(string(banner), "SSH-2.0-test") {
+			t.Errorf("%s: got banner %q, %v", test.name, banner, err)
+		}
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/stephane-martin/vssh/sys"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// SecretMode tells how the Vault secrets are given to the remote command.
+type SecretMode string
+
+const (
+	// SecretSetenv sends the secrets with SSH setenv requests. The server
+	// must accept them with AcceptEnv.
+	SecretSetenv SecretMode = "setenv"
+	// SecretFile writes the secrets to a remote file, that the login shell
+	// sources and deletes before running the command.
+	SecretFile SecretMode = "file"
+	// SecretStdin writes the secrets to the standard input, before the local
+	// standard input.
+	SecretStdin SecretMode = "stdin"
+)
+
+// ParseSecretMode parses the --secret-mode flag.
+func ParseSecretMode(s string) (SecretMode, error) {
+	switch mode := SecretMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case SecretSetenv, SecretFile, SecretStdin:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown secret mode: %s", s)
+	}
+}
+
+// secretDirs are the remote directories for the secrets file, in order of
+// preference. /dev/shm is a tmpfs, so that the secrets never reach the disk.
+var secretDirs = []string{"/dev/shm", "/tmp"}
+
+// shellSyntax holds the syntax of a family of shells.
+type shellSyntax struct {
+	export func(k, v string) string
+	quote  func(s string) string
+	source string
+}
+
+var (
+	posixSyntax = shellSyntax{
+		export: func(k, v string) string { return fmt.Sprintf("export %s=%s", k, sys.EscapeString(v)) },
+		quote:  sys.EscapeString,
+		source: ".",
+	}
+	fishSyntax = shellSyntax{
+		export: func(k, v string) string { return fmt.Sprintf("set -gx %s %s", k, fishEscape(v)) },
+		quote:  fishEscape,
+		source: "source",
+	}
+	cshSyntax = shellSyntax{
+		export: func(k, v string) string { return fmt.Sprintf("setenv %s %s", k, cshEscape(v)) },
+		quote:  cshEscape,
+		source: "source",
+	}
+)
+
+// fishEscape quotes s for fish. Inside single quotes, fish only gives a
+// meaning to \' and \\.
+func fishEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// cshEscape quotes s for csh and tcsh. A single quote can't be escaped inside
+// single quotes, and a newline inside quotes must follow a backslash.
+func cshEscape(s string) string {
+	s = strings.Replace(s, "'", `'\''`, -1)
+	return "'" + strings.Replace(s, "\n", "\\\n", -1) + "'"
+}
+
+func syntaxOf(shell string) shellSyntax {
+	switch path.Base(shell) {
+	case "fish":
+		return fishSyntax
+	case "csh", "tcsh":
+		return cshSyntax
+	default:
+		return posixSyntax
+	}
+}
+
+// exports returns the shell lines that export env, sorted by name.
+func exports(env map[string]string, syntax shellSyntax) []byte {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		b.WriteString(syntax.export(k, env[k]))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// loginShell returns the login shell of the remote user.
+func loginShell(conn *ssh.Client) (string, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = session.Close() }()
+	out, err := session.Output("echo $SHELL")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// setenv sends env with setenv requests, before the command is started.
+func setenv(session *ssh.Session, env map[string]string) error {
+	for k, v := range env {
+		err := session.Setenv(k, v)
+		if err != nil {
+			return fmt.Errorf("failed to set %s, the server must accept it with AcceptEnv: %s", k, err)
+		}
+	}
+	return nil
+}
+
+// secretScript returns the standard input and the command that give the
+// secrets to command. Without a command, the login shell reads the secrets
+// from its standard input, then the local standard input. With a command, the
+// login shell may read its standard input ahead, so sh reads exactly the
+// secrets with dd, then runs command with the login shell: command reads the
+// local standard input.
+func secretScript(conn *ssh.Client, env map[string]string, command string, l *zap.SugaredLogger) (io.Reader, string, error) {
+	shell, err := loginShell(conn)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get the remote login shell: %s", err)
+	}
+	l.Debugw("remote login shell", "shell", shell)
+	syntax := syntaxOf(shell)
+	if command == "" {
+		script := exports(env, syntax)
+		return io.MultiReader(bytes.NewReader(script), os.Stdin), "", nil
+	}
+	script := exports(env, posixSyntax)
+	return io.MultiReader(bytes.NewReader(script), os.Stdin), secretCommand(len(script), command, syntax), nil
+}
+
+// secretCommand returns the command that reads the secrets script of length
+// n from the standard input, and then runs command with the login shell. The
+// command is parsed by the login shell first, so it is quoted with syntax.
+func secretCommand(n int, command string, syntax shellSyntax) string {
+	wrapper := fmt.Sprintf(`eval "$(dd bs=1 count=%d 2>/dev/null)"; exec "$SHELL" -c "$1"`, n)
+	return "sh -c " + syntax.quote(wrapper) + " sh " + syntax.quote(command)
+}
+
+// writeSecretFile writes the secrets to a remote file with SFTP, and returns
+// the command that sources and deletes the file before running command, or
+// the login shell if command is empty. cleanup removes the file, in case the
+// command did not run.
+//
+// SFTP can't set the permissions when a file is created, so the file is
+// created in a new directory that is made private first: nobody else can
+// open the file, even in the meantime.
+func writeSecretFile(conn *ssh.Client, env map[string]string, command string, l *zap.SugaredLogger) (newCommand string, cleanup func(), err error) {
+	shell, err := loginShell(conn)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get the remote login shell: %s", err)
+	}
+	l.Debugw("remote login shell", "shell", shell)
+	syntax := syntaxOf(shell)
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start SFTP: %s", err)
+	}
+	dir := ""
+	for _, d := range secretDirs {
+		if fi, err := client.Stat(d); err == nil && fi.IsDir() {
+			dir = d
+			break
+		}
+	}
+	if dir == "" {
+		_ = client.Close()
+		return "", nil, fmt.Errorf("no remote directory for the secrets file")
+	}
+	if dir != secretDirs[0] {
+		l.Warnw("the secrets file is not written to a tmpfs", "dir", dir)
+	}
+	name := make([]byte, 16)
+	_, err = rand.Read(name)
+	if err != nil {
+		_ = client.Close()
+		return "", nil, err
+	}
+	secretDir := path.Join(dir, ".vssh-"+hex.EncodeToString(name))
+	secretPath := path.Join(secretDir, "env")
+	// Mkdir fails if the path already exists, so it can't be a symlink
+	// prepared by someone else
+	err = client.Mkdir(secretDir)
+	if err != nil {
+		_ = client.Close()
+		return "", nil, fmt.Errorf("failed to create the secrets directory: %s", err)
+	}
+	cleanup = func() {
+		_ = client.Remove(secretPath)
+		_ = client.RemoveDirectory(secretDir)
+		_ = client.Close()
+	}
+	err = privateDir(client, secretDir)
+	if err == nil {
+		err = writePrivateFile(client, secretPath, exports(env, syntax))
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write the secrets file: %s", err)
+	}
+	if command == "" {
+		command = "exec $SHELL -l"
+	}
+	newCommand = fmt.Sprintf(
+		"%s %s; rm -rf %s; %s",
+		syntax.source, syntax.quote(secretPath), syntax.quote(secretDir), command,
+	)
+	return newCommand, cleanup, nil
+}
+
+// privateDir restricts dir to its owner, and checks that it worked.
+func privateDir(client *sftp.Client, dir string) error {
+	err := client.Chmod(dir, 0700)
+	if err != nil {
+		return err
+	}
+	fi, err := client.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		return fmt.Errorf("unexpected mode for %s: %s", dir, fi.Mode())
+	}
+	return nil
+}
+
+// writePrivateFile creates the new file p with mode 0600, and writes content.
+func writePrivateFile(client *sftp.Client, p string, content []byte) error {
+	f, err := client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
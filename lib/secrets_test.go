@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var secretValues = []string{
+	"simple",
+	"it's",
+	`back\slash`,
+	`trailing\`,
+	"$HOME and ${USER} and `id`",
+	"first line\nsecond line",
+	"\\\n'$\n",
+	"",
+}
+
+func TestExports(t *testing.T) {
+	tests := []struct {
+		name   string
+		syntax shellSyntax
+		value  string
+		want   string
+	}{
+		{"sh", posixSyntax, "it's", `export K='it'"'"'s'`},
+		{"sh", posixSyntax, `a\b`, `export K='a\b'`},
+		{"sh", posixSyntax, "$HOME", `export K='$HOME'`},
+		{"sh", posixSyntax, "a\nb", "export K='a\nb'"},
+		{"fish", fishSyntax, "it's", `set -gx K 'it\'s'`},
+		{"fish", fishSyntax, `a\b`, `set -gx K 'a\\b'`},
+		{"fish", fishSyntax, `a\'`, `set -gx K 'a\\\''`},
+		{"fish", fishSyntax, "$HOME", `set -gx K '$HOME'`},
+		{"fish", fishSyntax, "a\nb", "set -gx K 'a\nb'"},
+		{"csh", cshSyntax, "it's", `setenv K 'it'\''s'`},
+		{"csh", cshSyntax, `a\b`, `setenv K 'a\b'`},
+		{"csh", cshSyntax, "$HOME", `setenv K '$HOME'`},
+		{"csh", cshSyntax, "a\nb", "setenv K 'a\\\nb'"},
+	}
+	for _, test := range tests {
+		got := string(exports(map[string]string{"K": test.value}, test.syntax))
+		if got != test.want+"\n" {
+			t.Errorf("%s, %q: got %q, want %q", test.name, test.value, got, test.want+"\n")
+		}
+	}
+}
+
+func TestSyntaxOf(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  string
+	}{
+		{"/bin/bash", "export"},
+		{"/bin/sh", "export"},
+		{"", "export"},
+		{"/usr/bin/fish", "set -gx"},
+		{"/bin/csh", "setenv"},
+		{"/bin/tcsh", "setenv"},
+	}
+	for _, test := range tests {
+		if got := syntaxOf(test.shell).export("K", "v"); !strings.HasPrefix(got, test.want+" ") {
+			t.Errorf("syntaxOf(%q): got %s", test.shell, got)
+		}
+	}
+}
+
+// TestExportsShells sources the exports with the shells that are installed,
+// and checks that the environment variables have the exact values.
+func TestExportsShells(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vssh-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	env := make(map[string]string)
+	for i, v := range secretValues {
+		env["VSSH_TEST_"+string('A'+rune(i))] = v
+	}
+
+	for _, shell := range []string{"sh", "dash", "bash", "zsh", "fish", "csh", "tcsh"} {
+		binary, err := exec.LookPath(shell)
+		if err != nil {
+			continue
+		}
+		syntax := syntaxOf(binary)
+		path := filepath.Join(dir, shell)
+		err = ioutil.WriteFile(path, exports(env, syntax), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range env {
+			script := syntax.source + " " + path + "; printenv " + k
+			out, err := exec.Command(binary, "-c", script).Output()
+			if err != nil {
+				t.Errorf("%s: %s failed: %s", shell, script, err)
+				continue
+			}
+			if got := strings.TrimSuffix(string(out), "\n"); got != want {
+				t.Errorf("%s: got %q, want %q", shell, got, want)
+			}
+		}
+	}
+}
+
+// TestSecretCommand runs the command of the stdin mode with the shells that
+// are installed, as the login shell: the command must get the secrets and
+// the rest of the standard input.
+func TestSecretCommand(t *testing.T) {
+	env := make(map[string]string)
+	for i, v := range secretValues {
+		env["VSSH_TEST_"+string('A'+rune(i))] = v
+	}
+	script := exports(env, posixSyntax)
+	const data = "first line of data\nsecond line\n"
+
+	for _, shell := range []string{"sh", "dash", "bash", "zsh", "fish", "csh", "tcsh"} {
+		binary, err := exec.LookPath(shell)
+		if err != nil {
+			continue
+		}
+		for k, want := range env {
+			command := secretCommand(len(script), "printenv "+k+"; cat", syntaxOf(binary))
+			cmd := exec.Command(binary, "-c", command)
+			cmd.Env = append(os.Environ(), "SHELL="+binary)
+			cmd.Stdin = strings.NewReader(string(script) + data)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				t.Errorf("%s: %s failed: %s: %s", shell, command, err, stderr.String())
+				continue
+			}
+			if got := string(out); got != want+"\n"+data {
+				t.Errorf("%s: got %q, want %q", shell, got, want+"\n"+data)
+			}
+		}
+	}
+}
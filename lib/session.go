@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/stephane-martin/vssh/params"
+
+	gssh "github.com/stephane-martin/golang-ssh"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// StartCommand connects to the SSH server and starts command, without waiting
+// for it to finish. Like with gssh.StartCommand, the Wait method of the
+// returned client waits for the command to exit, and closes the connection.
+func StartCommand(ctx context.Context, sshParams params.SSHParams, auth []ssh.AuthMethod, command string, l *zap.SugaredLogger) (*gssh.Client, error) {
+	conn, err := Dial(ctx, sshParams, auth, l)
+	if err != nil {
+		return nil, err
+	}
+	c := &gssh.Client{Conn: conn}
+	c.Session, err = conn.NewSession()
+	if err == nil {
+		c.Stdin, err = c.Session.StdinPipe()
+	}
+	if err == nil {
+		c.Stdout, err = c.Session.StdoutPipe()
+	}
+	if err == nil {
+		c.Stderr, err = c.Session.StderrPipe()
+	}
+	if err == nil {
+		err = c.Session.Start(command)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go closeOnCancel(ctx, conn)
+	return c, nil
+}
+
+// closeOnCancel closes the connection when ctx is canceled.
+func closeOnCancel(ctx context.Context, conn *ssh.Client) {
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.Wait()
+		close(closed)
+	}()
+	select {
+	case <-ctx.Done():
+		_ = conn.Close()
+	case <-closed:
+	}
+}
+
+// shell requests a pseudo-terminal and runs the login shell, or the command
+// if there is one, with the local terminal in raw mode. env is sent with
+// setenv requests. escape is the escape character, or NoEscape.
+func shell(ctx context.Context, conn *ssh.Client, command string, env map[string]string, escape int, l *zap.SugaredLogger) error {
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Close() }()
+	err = setenv(session, env)
+	if err != nil {
+		return err
+	}
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	width, height := 80, 24
+	var filter *escapeFilter
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		oldState, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = terminal.Restore(fd, oldState) }()
+		if w, h, err := terminal.GetSize(fd); err == nil {
+			width, height = w, h
+		}
+		if escape != NoEscape {
+			filter = newEscapeFilter(byte(escape), conn, session, fd, oldState, l)
+			defer filter.Close()
+			session.Stdin = filter
+		}
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO: 1,
+	}
+	err = session.RequestPty("xterm", height, width, modes)
+	if err != nil {
+		return err
+	}
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-lctx.Done()
+		_ = session.Close()
+	}()
+
+	if command != "" {
+		err = session.Start(command)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		return err
+	}
+	stop := watchWindowSize(session, fd)
+	defer stop()
+	err = session.Wait()
+	if filter != nil && filter.Disconnected() {
+		return errors.New("connection closed")
+	}
+	return err
+}
+
+// execCommand runs command, or the login shell if command is empty, without
+// a pseudo-terminal. stdin is streamed to the remote command, and its end is
+// sent as EOF. env is sent with setenv requests.
+func execCommand(ctx context.Context, conn *ssh.Client, command string, stdin io.Reader, env map[string]string) error {
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Close() }()
+	err = setenv(session, env)
+	if err != nil {
+		return err
+	}
+	session.Stdin = stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-lctx.Done()
+		_ = session.Close()
+	}()
+
+	if command != "" {
+		return session.Run(command)
+	}
+	err = session.Shell()
+	if err != nil {
+		return err
+	}
+	return session.Wait()
+}
+
+// WantTTY tells whether to request a pseudo-terminal, like OpenSSH: for the
+// login shell, or for a command with -t, when the local standard input is a
+// terminal. -T disables it.
+func WantTTY(force, disable, command bool, l *zap.SugaredLogger) bool {
+	if disable || (command && !force) {
+		return false
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		if force {
+			l.Warnw("pseudo-terminal will not be allocated because stdin is not a terminal")
+		}
+		return false
+	}
+	return true
+}
+
+// watchWindowSize forwards the local window size changes to the remote
+// pseudo-terminal.
+func watchWindowSize(session *ssh.Session, fd int) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	go func() {
+		for range sigs {
+			sendWindowSize(session, fd)
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}
+}
+
+// sendWindowSize sends the local window size to the remote pseudo-terminal.
+func sendWindowSize(session *ssh.Session, fd int) {
+	w, h, err := terminal.GetSize(fd)
+	if err != nil {
+		return
+	}
+	size := make([]byte, 16)
+	binary.BigEndian.PutUint32(size, uint32(w))
+	binary.BigEndian.PutUint32(size[4:], uint32(h))
+	_, _ = session.SendRequest("window-change", false, size)
+}
@@ -16,7 +16,6 @@ import (
 
 	"github.com/awnumar/memguard"
 	"github.com/stephane-martin/go-vis"
-	gssh "github.com/stephane-martin/golang-ssh"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -99,19 +98,7 @@ func SFTPPutAuth(ctx context.Context, sources []Source, remotePath string, gpara
 		remotePath = "."
 	}
 
-	cfg := gssh.Config{
-		User:      gparams.LoginName,
-		Host:      gparams.Host,
-		Port:      gparams.Port,
-		Auth:      auth,
-		HTTPProxy: gparams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(ctx, cfg)
+	client, err := SFTP(ctx, gparams, auth, l)
 	if err != nil {
 		return err
 	}
@@ -254,19 +241,6 @@ func ScpPutAuth(ctx context.Context, sources []Source, remotePath string, gparam
 	if remotePath == "" {
 		remotePath = "."
 	}
-	cfg := gssh.Config{
-		User:      gparams.LoginName,
-		Host:      gparams.Host,
-		Port:      gparams.Port,
-		Auth:      auth,
-		HTTPProxy: gparams.HTTPProxy,
-	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
-	if err != nil {
-		return err
-	}
-	cfg.HostKey = hkcb
-
 	opts := "-q -t"
 	if hasDir(sources) {
 		opts += " -r"
@@ -282,7 +256,7 @@ func ScpPutAuth(ctx context.Context, sources []Source, remotePath string, gparam
 	}
 	command := fmt.Sprintf("scp %s %s", opts, p)
 	l.Debugw("remote command", "cmd", command)
-	client, err := gssh.StartCommand(ctx, cfg, command)
+	client, err := StartCommand(ctx, gparams, auth, command, l)
 	if err != nil {
 		return err
 	}
@@ -1,35 +1,240 @@
 package params
 
-import "github.com/urfave/cli"
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
 
 type CLIContext interface {
 	VaultAddress() string
 	VaultToken() string
+	VaultTokenHelper() string
 	VaultAuthMethod() string
 	VaultAuthPath() string
+	VaultAuthRole() string
 	VaultUsername() string
 	VaultPassword() string
+	VaultJWT() string
+	VaultKubernetesTokenFile() string
+	VaultClientCert() string
+	VaultClientKey() string
+	VaultCACert() string
+	VaultCAPath() string
+	VaultTLSServerName() string
+	VaultSkipVerify() bool
+	VaultNamespace() string
+	VaultOIDCPort() int
 	VaultSSHMount() string
 	VaultSSHRole() string
+	VaultSSHMode() string
+	VaultSSHHostMount() string
+	RevokedHostKeys() string
+	HostMapping() (HostMapping, error)
+	SSHConfig() (SSHConfig, error)
+	SSHConfigFile() string
 	SSHHost() string
 	SSHCommand() []string
 	SSHLogin() string
 	SSHPort() int
+	ProxyJump() string
+	ForJumpHost(h JumpHost) CLIContext
+	ForHost(host string) CLIContext
 	SSHPassword() bool
 	SSHAgent() bool
+	SSHAgentKey() string
 	SSHInsecure() bool
 	HTTPProxy() string
-	PrivateKey() string
+	ProxySecret() string
+	PrivateKeys() []string
 	VPrivateKey() string
 	ForceTerminal() bool
+	NoTerminal() bool
+	CertCache() bool
+	Ephemeral() bool
+	EphemeralTTL() time.Duration
+	CertTTL() time.Duration
+	CertPrincipals() []string
+	CertExtensions() []string
+	CertCriticalOptions() []string
+	CertKeyID() string
+	Profile() string
+	ConfigFile() string
 }
 
 func NewCliContext(ctx *cli.Context) CLIContext {
-	return cliContext{ctx: ctx}
+	return cliContext{ctx: ctx, hostMapping: new(hostMappingResult), sshConfig: new(sshConfigResult)}
 }
 
 type cliContext struct {
-	ctx *cli.Context
+	ctx         *cli.Context
+	hostMapping *hostMappingResult
+	sshConfig   *sshConfigResult
+	jump        *JumpHost
+	host        string
+}
+
+// ForHost returns the context to connect to another target host, like the
+// host typed in the connection form. The host mapping and ssh_config are
+// looked up for that host.
+func (c cliContext) ForHost(host string) CLIContext {
+	return cliContext{ctx: c.ctx, hostMapping: new(hostMappingResult), sshConfig: new(sshConfigResult), host: host}
+}
+
+// ForJumpHost returns the context to connect to a jump host. The options that
+// only concern the target host, like the login and the port, are not applied
+// to the jump host.
+func (c cliContext) ForJumpHost(h JumpHost) CLIContext {
+	return cliContext{ctx: c.ctx, hostMapping: new(hostMappingResult), sshConfig: new(sshConfigResult), jump: &h}
+}
+
+// isSet tells if the global flag was given for the host of the context. The
+// flags set by the profile don't count, as the host mapping and ssh_config
+// take precedence over the profile.
+func (c cliContext) isSet(name string) bool {
+	if c.jump != nil {
+		switch name {
+		case "login":
+			return false
+		case "ssh-port":
+			return c.jump.Port != 0
+		}
+	}
+	return globalIsSet(c.ctx, name) && !FromProfile(c.ctx, name)
+}
+
+// globalIsSet tells if the global flag was set under any of its names, like
+// -i for --privkey: urfave/cli only knows the name that was used.
+func globalIsSet(c *cli.Context, name string) bool {
+	// the subcommands of a command, like scp put, have their own App
+	root := c
+	for root.Parent() != nil {
+		root = root.Parent()
+	}
+	for _, f := range root.App.Flags {
+		aliases := strings.Split(f.GetName(), ",")
+		if strings.TrimSpace(aliases[0]) != name {
+			continue
+		}
+		for _, alias := range aliases {
+			if c.GlobalIsSet(strings.TrimSpace(alias)) {
+				return true
+			}
+		}
+		return false
+	}
+	return c.GlobalIsSet(name)
+}
+
+type hostMappingResult struct {
+	done    bool
+	mapping HostMapping
+	err     error
+}
+
+type sshConfigResult struct {
+	done   bool
+	config SSHConfig
+	err    error
+}
+
+// HostMapping returns the mapping for the target host. The fields given on
+// the command line are left empty, as the flags take precedence.
+func (c cliContext) HostMapping() (HostMapping, error) {
+	if c.hostMapping.done {
+		return c.hostMapping.mapping, c.hostMapping.err
+	}
+	c.hostMapping.done = true
+	host := strings.TrimSpace(c.SSHHost())
+	if idx := strings.LastIndex(host, "@"); idx != -1 {
+		host = host[idx+1:]
+	}
+	mappings, err := ReadHostMappings(c.ctx.GlobalString("host-map"))
+	if err != nil {
+		c.hostMapping.err = err
+		return HostMapping{}, err
+	}
+	m := MatchHost(mappings, host)
+	if c.isSet("vault-ssh-mount") {
+		m.Mount = ""
+	}
+	if c.isSet("vault-ssh-role") {
+		m.Role = ""
+	}
+	if c.isSet("login") {
+		m.Login = ""
+	}
+	if c.isSet("ssh-port") {
+		m.Port = 0
+	}
+	if c.isSet("privkey") {
+		m.Key = ""
+	}
+	c.hostMapping.mapping = m
+	return m, nil
+}
+
+// SSHConfig returns the ssh_config options for the target host. As with
+// OpenSSH, the options given on the command line take precedence.
+func (c cliContext) SSHConfig() (SSHConfig, error) {
+	if c.sshConfig.done {
+		return c.sshConfig.config, c.sshConfig.err
+	}
+	c.sshConfig.done = true
+	host := strings.TrimSpace(c.SSHHost())
+	var login string
+	if idx := strings.LastIndex(host, "@"); idx != -1 {
+		login = host[:idx]
+		host = host[idx+1:]
+	} else if c.isSet("login") {
+		login = c.SSHLogin()
+	}
+	paths := []string{DefaultSSHConfigFile, SystemSSHConfigFile}
+	if path := c.SSHConfigFile(); path != "" {
+		paths = []string{path}
+		if strings.ToLower(path) != "none" {
+			expanded, err := homedir.Expand(path)
+			if err == nil {
+				_, err = os.Stat(expanded)
+			}
+			if err != nil {
+				c.sshConfig.err = fmt.Errorf("failed to read ssh_config: %s", err)
+				return SSHConfig{}, c.sshConfig.err
+			}
+		}
+	}
+	config, err := LookupSSHConfig(paths, host, login)
+	if err != nil {
+		c.sshConfig.err = err
+		return SSHConfig{}, err
+	}
+	if c.isSet("login") {
+		config.User = ""
+	}
+	if c.isSet("ssh-port") {
+		config.Port = 0
+	}
+	if c.isSet("privkey") {
+		config.IdentityFiles = nil
+	}
+	if c.jump != nil {
+		config.ProxyJump = ""
+	}
+	c.sshConfig.config = config
+	return config, nil
+}
+
+// SSHConfigFile returns the ssh_config file given on the command line, or
+// an empty string for the default files.
+func (c cliContext) SSHConfigFile() string {
+	if !globalIsSet(c.ctx, "ssh-config") {
+		return ""
+	}
+	return c.ctx.GlobalString("ssh-config")
 }
 
 func (c cliContext) VaultAddress() string {
@@ -40,6 +245,10 @@ func (c cliContext) VaultToken() string {
 	return c.ctx.GlobalString("vault-token")
 }
 
+func (c cliContext) VaultTokenHelper() string {
+	return c.ctx.GlobalString("vault-token-helper")
+}
+
 func (c cliContext) VaultAuthMethod() string {
 	return c.ctx.GlobalString("vault-auth-method")
 }
@@ -48,6 +257,10 @@ func (c cliContext) VaultAuthPath() string {
 	return c.ctx.GlobalString("vault-auth-path")
 }
 
+func (c cliContext) VaultAuthRole() string {
+	return c.ctx.GlobalString("vault-auth-role")
+}
+
 func (c cliContext) VaultUsername() string {
 	return c.ctx.GlobalString("vault-username")
 }
@@ -56,6 +269,46 @@ func (c cliContext) VaultPassword() string {
 	return c.ctx.GlobalString("vault-password")
 }
 
+func (c cliContext) VaultJWT() string {
+	return c.ctx.GlobalString("vault-jwt")
+}
+
+func (c cliContext) VaultKubernetesTokenFile() string {
+	return c.ctx.GlobalString("vault-kubernetes-token-file")
+}
+
+func (c cliContext) VaultClientCert() string {
+	return c.ctx.GlobalString("vault-client-cert")
+}
+
+func (c cliContext) VaultClientKey() string {
+	return c.ctx.GlobalString("vault-client-key")
+}
+
+func (c cliContext) VaultCACert() string {
+	return c.ctx.GlobalString("vault-cacert")
+}
+
+func (c cliContext) VaultCAPath() string {
+	return c.ctx.GlobalString("vault-capath")
+}
+
+func (c cliContext) VaultTLSServerName() string {
+	return c.ctx.GlobalString("vault-tls-server-name")
+}
+
+func (c cliContext) VaultSkipVerify() bool {
+	return c.ctx.GlobalBool("vault-skip-verify")
+}
+
+func (c cliContext) VaultNamespace() string {
+	return c.ctx.GlobalString("vault-namespace")
+}
+
+func (c cliContext) VaultOIDCPort() int {
+	return c.ctx.GlobalInt("vault-oidc-port")
+}
+
 func (c cliContext) VaultSSHMount() string {
 	return c.ctx.GlobalString("vault-ssh-mount")
 }
@@ -64,14 +317,35 @@ func (c cliContext) VaultSSHRole() string {
 	return c.ctx.GlobalString("vault-ssh-role")
 }
 
+func (c cliContext) VaultSSHMode() string {
+	return strings.ToLower(strings.TrimSpace(c.ctx.GlobalString("vault-ssh-mode")))
+}
+
+func (c cliContext) VaultSSHHostMount() string {
+	return c.ctx.GlobalString("vault-ssh-host-mount")
+}
+
+func (c cliContext) RevokedHostKeys() string {
+	return c.ctx.GlobalString("revoked-host-keys")
+}
+
 func (c cliContext) SSHCommand() []string {
-	if len(c.ctx.Args()) == 0 {
+	if c.jump != nil || len(c.ctx.Args()) == 0 {
 		return nil
 	}
 	return c.ctx.Args()[1:]
 }
 
 func (c cliContext) SSHHost() string {
+	if c.jump != nil {
+		if c.jump.Login != "" {
+			return c.jump.Login + "@" + c.jump.Host
+		}
+		return c.jump.Host
+	}
+	if c.host != "" {
+		return c.host
+	}
 	if len(c.ctx.Args()) == 0 {
 		return ""
 	}
@@ -79,13 +353,29 @@ func (c cliContext) SSHHost() string {
 }
 
 func (c cliContext) SSHLogin() string {
+	if c.jump != nil {
+		return ""
+	}
 	return c.ctx.GlobalString("login")
 }
 
 func (c cliContext) SSHPort() int {
+	if c.jump != nil {
+		if c.jump.Port != 0 {
+			return c.jump.Port
+		}
+		return 22
+	}
 	return c.ctx.GlobalInt("ssh-port")
 }
 
+func (c cliContext) ProxyJump() string {
+	if c.jump != nil {
+		return ""
+	}
+	return strings.TrimSpace(c.ctx.GlobalString("jump-host"))
+}
+
 func (c cliContext) SSHPassword() bool {
 	return c.ctx.GlobalBool("password")
 }
@@ -94,6 +384,10 @@ func (c cliContext) SSHAgent() bool {
 	return c.ctx.GlobalBool("agent")
 }
 
+func (c cliContext) SSHAgentKey() string {
+	return c.ctx.GlobalString("agent-key")
+}
+
 func (c cliContext) SSHInsecure() bool {
 	return c.ctx.GlobalBool("insecure")
 }
@@ -102,8 +396,19 @@ func (c cliContext) HTTPProxy() string {
 	return c.ctx.GlobalString("http-proxy")
 }
 
-func (c cliContext) PrivateKey() string {
-	return c.ctx.GlobalString("privkey")
+func (c cliContext) ProxySecret() string {
+	return strings.TrimSpace(c.ctx.GlobalString("proxy-secret"))
+}
+
+func (c cliContext) PrivateKeys() []string {
+	var paths []string
+	for _, path := range c.ctx.GlobalStringSlice("privkey") {
+		path = strings.TrimSpace(path)
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
 }
 
 func (c cliContext) VPrivateKey() string {
@@ -113,3 +418,47 @@ func (c cliContext) VPrivateKey() string {
 func (c cliContext) ForceTerminal() bool {
 	return c.ctx.Bool("terminal")
 }
+
+func (c cliContext) NoTerminal() bool {
+	return c.ctx.Bool("no-terminal")
+}
+
+func (c cliContext) CertCache() bool {
+	return !c.ctx.GlobalBool("no-cert-cache")
+}
+
+func (c cliContext) Ephemeral() bool {
+	return c.ctx.GlobalBool("ephemeral")
+}
+
+func (c cliContext) EphemeralTTL() time.Duration {
+	return c.ctx.GlobalDuration("ephemeral-ttl")
+}
+
+func (c cliContext) CertTTL() time.Duration {
+	return c.ctx.GlobalDuration("cert-ttl")
+}
+
+func (c cliContext) CertPrincipals() []string {
+	return c.ctx.GlobalStringSlice("principal")
+}
+
+func (c cliContext) CertExtensions() []string {
+	return c.ctx.GlobalStringSlice("extension")
+}
+
+func (c cliContext) CertCriticalOptions() []string {
+	return c.ctx.GlobalStringSlice("critical-option")
+}
+
+func (c cliContext) CertKeyID() string {
+	return c.ctx.GlobalString("key-id")
+}
+
+func (c cliContext) Profile() string {
+	return strings.TrimSpace(c.ctx.GlobalString("profile"))
+}
+
+func (c cliContext) ConfigFile() string {
+	return c.ctx.GlobalString("config")
+}
@@ -0,0 +1,146 @@
+package params
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/go-homedir"
+)
+
+// DefaultHostMapFile is the default path of the host mapping file.
+const DefaultHostMapFile = "~/.config/vssh/hosts.hcl"
+
+// HostMapping gives the Vault SSH mount and role, and the SSH parameters, to
+// use for the hosts that match Pattern. Pattern is a list of shell globs or
+// CIDR blocks, separated by spaces or commas.
+//
+//	host "*.prod.example.com 10.1.0.0/16" {
+//	  mount = "ssh-prod"
+//	  role  = "admin"
+//	  login = "admin"
+//	  port  = 2222
+//	  key   = "~/.ssh/id_prod"
+//	}
+type HostMapping struct {
+	Pattern string `hcl:",key"`
+	Mount   string `hcl:"mount"`
+	Role    string `hcl:"role"`
+	Login   string `hcl:"login"`
+	Port    int    `hcl:"port"`
+	Key     string `hcl:"key"`
+}
+
+// ReadHostMappings reads the host mapping file at path. A missing file is not
+// an error.
+func ReadHostMappings(path string) ([]HostMapping, error) {
+	if path == "" {
+		return nil, nil
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host mapping file: %s", err)
+	}
+	var config struct {
+		Hosts []HostMapping `hcl:"host"`
+	}
+	err = hcl.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host mapping file: %s", err)
+	}
+	for _, m := range config.Hosts {
+		for _, pattern := range splitPatterns(m.Pattern) {
+			if strings.Contains(pattern, "/") {
+				if _, _, err := net.ParseCIDR(pattern); err != nil {
+					return nil, fmt.Errorf("invalid CIDR in host mapping file: %s", pattern)
+				}
+			} else if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern in host mapping file: %s", pattern)
+			}
+		}
+	}
+	return config.Hosts, nil
+}
+
+// MatchHost returns the mapping for host. Like in ssh_config, for each field,
+// the first mapping that matches the host and sets the field wins.
+func MatchHost(mappings []HostMapping, host string) (m HostMapping) {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" {
+		return m
+	}
+	var ips []net.IP
+	var resolved bool
+	for _, mapping := range mappings {
+		matched := false
+		for _, pattern := range splitPatterns(mapping.Pattern) {
+			if strings.Contains(pattern, "/") {
+				if !resolved {
+					resolved = true
+					ips = hostIPs(host)
+				}
+				_, network, err := net.ParseCIDR(pattern)
+				if err != nil {
+					continue
+				}
+				for _, ip := range ips {
+					if network.Contains(ip) {
+						matched = true
+					}
+				}
+			} else if ok, _ := filepath.Match(strings.ToLower(pattern), host); ok {
+				matched = true
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if m.Mount == "" {
+			m.Mount = mapping.Mount
+		}
+		if m.Role == "" {
+			m.Role = mapping.Role
+		}
+		if m.Login == "" {
+			m.Login = mapping.Login
+		}
+		if m.Port == 0 {
+			m.Port = mapping.Port
+		}
+		if m.Key == "" {
+			m.Key = mapping.Key
+		}
+	}
+	return m
+}
+
+func splitPatterns(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+func hostIPs(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
@@ -0,0 +1,88 @@
+package params
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadHostMappings(t *testing.T) {
+	dir := writeSSHConfig(t, map[string]string{
+		"hosts.hcl": `
+host "*.prod.example.com, 10.1.0.0/16" {
+  mount = "ssh-prod"
+  role  = "admin"
+  login = "admin"
+  port  = 2222
+  key   = "~/.ssh/id_prod"
+}
+
+host "*" {
+  role = "default"
+}
+`,
+		"bad-cidr.hcl":    `host "10.1.0.0/33" { role = "r" }`,
+		"bad-pattern.hcl": `host "web[" { role = "r" }`,
+		"bad-syntax.hcl":  `host "web" { role = }`,
+	})
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	mappings, err := ReadHostMappings(filepath.Join(dir, "hosts.hcl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HostMapping{
+		{Pattern: "*.prod.example.com, 10.1.0.0/16", Mount: "ssh-prod", Role: "admin", Login: "admin", Port: 2222, Key: "~/.ssh/id_prod"},
+		{Pattern: "*", Role: "default"},
+	}
+	if len(mappings) != len(want) {
+		t.Fatalf("got %+v, want %+v", mappings, want)
+	}
+	for i := range want {
+		if mappings[i] != want[i] {
+			t.Errorf("mapping %d: got %+v, want %+v", i, mappings[i], want[i])
+		}
+	}
+
+	for _, name := range []string{"", filepath.Join(dir, "missing.hcl")} {
+		mappings, err := ReadHostMappings(name)
+		if err != nil || mappings != nil {
+			t.Errorf("%q: got %+v, %v", name, mappings, err)
+		}
+	}
+	for _, name := range []string{"bad-cidr.hcl", "bad-pattern.hcl", "bad-syntax.hcl"} {
+		if _, err := ReadHostMappings(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	mappings := []HostMapping{
+		{Pattern: "web.prod.example.com", Login: "deploy"},
+		{Pattern: "*.prod.example.com 10.1.0.0/16", Mount: "ssh-prod", Role: "admin", Port: 2222},
+		{Pattern: "db?.example.com,fd00::/8", Role: "dba", Key: "~/.ssh/id_db"},
+		{Pattern: "*", Mount: "ssh", Role: "default", Login: "root"},
+	}
+	tests := []struct {
+		host string
+		want HostMapping
+	}{
+		{"web.prod.example.com", HostMapping{Mount: "ssh-prod", Role: "admin", Login: "deploy", Port: 2222}},
+		{"API.PROD.example.com", HostMapping{Mount: "ssh-prod", Role: "admin", Login: "root", Port: 2222}},
+		{"10.1.2.3", HostMapping{Mount: "ssh-prod", Role: "admin", Login: "root", Port: 2222}},
+		{"10.2.0.1", HostMapping{Mount: "ssh", Role: "default", Login: "root"}},
+		{"db1.example.com", HostMapping{Mount: "ssh", Role: "dba", Login: "root", Key: "~/.ssh/id_db"}},
+		{"db12.example.com", HostMapping{Mount: "ssh", Role: "default", Login: "root"}},
+		{"[fd00::1]", HostMapping{Mount: "ssh", Role: "dba", Login: "root", Key: "~/.ssh/id_db"}},
+		{"", HostMapping{}},
+	}
+	for _, test := range tests {
+		if got := MatchHost(mappings, test.host); got != test.want {
+			t.Errorf("MatchHost(%q) = %+v, want %+v", test.host, got, test.want)
+		}
+	}
+	if got := MatchHost(nil, "web"); got != (HostMapping{}) {
+		t.Errorf("no mappings: got %+v", got)
+	}
+}
@@ -0,0 +1,69 @@
+package params
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpHost is a host of a ProxyJump chain: [user@]host[:port].
+type JumpHost struct {
+	Login string
+	Host  string
+	Port  int
+}
+
+func (h JumpHost) String() string {
+	s := h.Host
+	if h.Port != 0 {
+		s = net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
+	}
+	if h.Login != "" {
+		s = h.Login + "@" + s
+	}
+	return s
+}
+
+// JumpHop holds the parameters and the credentials to connect to a jump host.
+type JumpHop struct {
+	Params SSHParams
+	Auth   []ssh.AuthMethod
+}
+
+// ParseJumpHosts parses a ProxyJump specification, like
+// user@bastion:2222,other. The ssh:// URLs are accepted too.
+func ParseJumpHosts(s string) ([]JumpHost, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ToLower(s) == "none" {
+		return nil, nil
+	}
+	var hosts []JumpHost
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimPrefix(strings.TrimSpace(spec), "ssh://")
+		var h JumpHost
+		if idx := strings.LastIndex(spec, "@"); idx != -1 {
+			h.Login = spec[:idx]
+			spec = spec[idx+1:]
+		}
+		h.Host = spec
+		if strings.HasPrefix(spec, "[") || strings.Count(spec, ":") == 1 {
+			host, port, err := net.SplitHostPort(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jump host: %s", spec)
+			}
+			h.Host = host
+			h.Port, err = strconv.Atoi(port)
+			if err != nil || h.Port <= 0 || h.Port > 65535 {
+				return nil, fmt.Errorf("invalid jump host port: %s", spec)
+			}
+		}
+		if h.Host == "" {
+			return nil, fmt.Errorf("invalid jump host: %s", s)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,84 @@
+package params
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJumpHosts(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []JumpHost
+		err  bool
+	}{
+		{spec: "", want: nil},
+		{spec: "  ", want: nil},
+		{spec: "none", want: nil},
+		{spec: "NONE", want: nil},
+		{spec: "bastion", want: []JumpHost{{Host: "bastion"}}},
+		{spec: "alice@bastion", want: []JumpHost{{Login: "alice", Host: "bastion"}}},
+		{spec: "bastion:2222", want: []JumpHost{{Host: "bastion", Port: 2222}}},
+		{spec: "alice@bastion:2222", want: []JumpHost{{Login: "alice", Host: "bastion", Port: 2222}}},
+		{spec: "alice@example.org@bastion", want: []JumpHost{{Login: "alice@example.org", Host: "bastion"}}},
+		{spec: "[fd00::1]:2222", want: []JumpHost{{Host: "fd00::1", Port: 2222}}},
+		{spec: "alice@[fd00::1]:2222", want: []JumpHost{{Login: "alice", Host: "fd00::1", Port: 2222}}},
+		{spec: "fd00::1", want: []JumpHost{{Host: "fd00::1"}}},
+		{spec: "ssh://alice@bastion:2222", want: []JumpHost{{Login: "alice", Host: "bastion", Port: 2222}}},
+		{spec: "ssh://bastion", want: []JumpHost{{Host: "bastion"}}},
+		{
+			spec: "alice@first:2222, ssh://second,[fd00::1]:22",
+			want: []JumpHost{
+				{Login: "alice", Host: "first", Port: 2222},
+				{Host: "second"},
+				{Host: "fd00::1", Port: 22},
+			},
+		},
+		{spec: "bastion:ssh", err: true},
+		{spec: "bastion:0", err: true},
+		{spec: "bastion:65536", err: true},
+		{spec: "[fd00::1", err: true},
+		{spec: "alice@", err: true},
+		{spec: ":2222", err: true},
+		{spec: "first,,second", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseJumpHosts(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseJumpHosts(%q): expected an error, got %+v", test.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseJumpHosts(%q): unexpected error: %s", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseJumpHosts(%q) = %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestJumpHostString(t *testing.T) {
+	tests := []struct {
+		host JumpHost
+		want string
+	}{
+		{JumpHost{Host: "bastion"}, "bastion"},
+		{JumpHost{Login: "alice", Host: "bastion"}, "alice@bastion"},
+		{JumpHost{Login: "alice", Host: "bastion", Port: 2222}, "alice@bastion:2222"},
+		{JumpHost{Host: "fd00::1", Port: 2222}, "[fd00::1]:2222"},
+	}
+	for _, test := range tests {
+		if got := test.host.String(); got != test.want {
+			t.Errorf("%+v: got %s, want %s", test.host, got, test.want)
+		}
+	}
+	// String and ParseJumpHosts are the reverse of each other
+	for _, test := range tests {
+		hosts, err := ParseJumpHosts(test.want)
+		if err != nil || len(hosts) != 1 || hosts[0] != test.host {
+			t.Errorf("ParseJumpHosts(%q) = %+v, %v, want %+v", test.want, hosts, err, test.host)
+		}
+	}
+}
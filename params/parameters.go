@@ -1,14 +1,69 @@
 package params
 
+import "strings"
+
 type VaultParams struct {
-	Address    string
-	Token      string
-	AuthMethod string
-	AuthPath   string
-	Username   string
-	Password   string
-	SSHMount   string
-	SSHRole    string
+	Address             string
+	Token               string
+	TokenHelper         string
+	AuthMethod          string
+	AuthPath            string
+	AuthRole            string
+	Username            string
+	Password            string
+	JWT                 string
+	KubernetesTokenFile string
+	ClientCert          string
+	ClientKey           string
+	CACert              string
+	CAPath              string
+	TLSServerName       string
+	SkipVerify          bool
+	Namespace           string
+	OIDCPort            int
+	SSHMount            string
+	SSHRole             string
+}
+
+func GetVaultParams(c CLIContext) VaultParams {
+	p := VaultParams{
+		SSHMount:            c.VaultSSHMount(),
+		SSHRole:             c.VaultSSHRole(),
+		AuthMethod:          strings.ToLower(c.VaultAuthMethod()),
+		AuthPath:            c.VaultAuthPath(),
+		AuthRole:            c.VaultAuthRole(),
+		TokenHelper:         c.VaultTokenHelper(),
+		Address:             c.VaultAddress(),
+		Token:               c.VaultToken(),
+		Username:            c.VaultUsername(),
+		Password:            c.VaultPassword(),
+		JWT:                 c.VaultJWT(),
+		ClientCert:          c.VaultClientCert(),
+		ClientKey:           c.VaultClientKey(),
+		CACert:              c.VaultCACert(),
+		CAPath:              c.VaultCAPath(),
+		TLSServerName:       c.VaultTLSServerName(),
+		SkipVerify:          c.VaultSkipVerify(),
+		Namespace:           c.VaultNamespace(),
+		OIDCPort:            c.VaultOIDCPort(),
+		KubernetesTokenFile: c.VaultKubernetesTokenFile(),
+	}
+	// the errors of the host mapping file are reported by GetSSHParams
+	if mapping, err := c.HostMapping(); err == nil {
+		if mapping.Mount != "" {
+			p.SSHMount = mapping.Mount
+		}
+		if mapping.Role != "" {
+			p.SSHRole = mapping.Role
+		}
+	}
+	if p.AuthMethod == "" {
+		p.AuthMethod = "token"
+	}
+	if p.AuthPath == "" {
+		p.AuthPath = p.AuthMethod
+	}
+	return p
 }
 
 type Params struct {
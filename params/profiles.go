@@ -0,0 +1,269 @@
+package params
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli"
+)
+
+// DefaultConfigFile is the default path of the vssh configuration file.
+const DefaultConfigFile = "~/.config/vssh/config.toml"
+
+// Profile holds global options, by flag name.
+//
+//	[profiles.prod]
+//	vault-address = "https://vault.prod.example.com:8200"
+//	vault-ssh-mount = "ssh-prod"
+//	vault-ssh-role = "admin"
+//	principal = ["admin"]
+type Profile map[string]interface{}
+
+// SecretOptions are the options that are masked by "vssh profile show", and
+// that are never saved from the form. The credentials of the http-proxy URL
+// are handled the same way.
+var SecretOptions = []string{"vault-token", "vault-password", "vault-jwt"}
+
+// IsSecretOption tells if the option holds a secret.
+func IsSecretOption(name string) bool {
+	for _, secret := range SecretOptions {
+		if name == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// ShownOption returns the value of the option as shown by "vssh profile
+// show": the secrets are masked, and so is the password of the proxy URL.
+func ShownOption(name string, value interface{}) interface{} {
+	if IsSecretOption(name) {
+		return "********"
+	}
+	if s, ok := value.(string); ok && name == "http-proxy" {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				// the username is escaped, so the first @ ends it
+				u.User = url.User(u.User.Username())
+				return strings.Replace(u.String(), "@", ":********@", 1)
+			}
+		}
+	}
+	return value
+}
+
+// WithoutUserinfo removes the username and password from the proxy URL, so
+// that they are not saved in a profile.
+func WithoutUserinfo(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil || u.User == nil {
+		return proxy
+	}
+	u.User = nil
+	return u.String()
+}
+
+// ReadProfiles reads the profiles from the configuration file. A missing file
+// is not an error.
+func ReadProfiles(path string) (map[string]Profile, error) {
+	config, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]Profile)
+	for name, p := range config["profiles"].(map[string]interface{}) {
+		options, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid profile %s in configuration file", name)
+		}
+		profiles[name] = options
+	}
+	return profiles, nil
+}
+
+// ProfileNames returns the sorted names of the profiles.
+func ProfileNames(profiles map[string]Profile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]interface{})
+	_, err = toml.DecodeFile(path, &config)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if _, ok := config["profiles"]; !ok {
+		config["profiles"] = make(map[string]interface{})
+	}
+	if _, ok := config["profiles"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("invalid profiles in configuration file")
+	}
+	return config, nil
+}
+
+// profileFlagsKey is the key of the application metadata that holds the
+// flags set by ApplyProfile.
+const profileFlagsKey = "profile-flags"
+
+// ApplyProfile sets the global flags from the profile selected with
+// --profile. The flags given on the command line or by environment variables
+// take precedence over the profile.
+//
+// The profile is the lowest layer: the host mapping and ssh_config also take
+// precedence over it, so the flags it sets are recorded to tell them apart
+// from the command line (see FromProfile).
+func ApplyProfile(c *cli.Context) error {
+	name := strings.TrimSpace(c.GlobalString("profile"))
+	if name == "" {
+		return nil
+	}
+	profiles, err := ReadProfiles(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("profile not found: %s", name)
+	}
+	// the names of the flags, by alias
+	names := make(map[string]string)
+	for _, f := range c.App.Flags {
+		aliases := strings.Split(f.GetName(), ",")
+		for _, alias := range aliases {
+			names[strings.TrimSpace(alias)] = strings.TrimSpace(aliases[0])
+		}
+	}
+	// check what is set before setting anything
+	values := make(map[string][]string)
+	for option, value := range profile {
+		flagName, ok := names[option]
+		if !ok || flagName == "profile" || flagName == "config" {
+			return fmt.Errorf("unknown option in profile %s: %s", name, option)
+		}
+		if globalIsSet(c, flagName) {
+			continue
+		}
+		strValues, err := optionValues(value)
+		if err != nil {
+			return fmt.Errorf("invalid option in profile %s: %s: %s", name, option, err)
+		}
+		values[flagName] = strValues
+	}
+	fromProfile := make(map[string]bool, len(values))
+	for flagName, strValues := range values {
+		for _, v := range strValues {
+			err := c.GlobalSet(flagName, v)
+			if err != nil {
+				return fmt.Errorf("invalid option in profile %s: %s: %s", name, flagName, err)
+			}
+		}
+		fromProfile[flagName] = true
+	}
+	c.App.Metadata[profileFlagsKey] = fromProfile
+	return nil
+}
+
+// FromProfile tells if the global flag was set by the profile, and not on the
+// command line or by an environment variable.
+func FromProfile(c *cli.Context, flagName string) bool {
+	fromProfile, _ := c.App.Metadata[profileFlagsKey].(map[string]bool)
+	return fromProfile[flagName]
+}
+
+func optionValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case int64:
+		return []string{strconv.FormatInt(v, 10)}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case []interface{}:
+		var values []string
+		for _, elt := range v {
+			if _, ok := elt.([]interface{}); ok {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			strValues, err := optionValues(elt)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, strValues...)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type: %T", value)
+	}
+}
+
+// SaveProfile updates the profile with the given options in the configuration
+// file. The nil values remove the options from the profile. The other
+// profiles are kept.
+func SaveProfile(path, name string, options Profile) error {
+	config, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	profiles := config["profiles"].(map[string]interface{})
+	profile, _ := profiles[name].(map[string]interface{})
+	if profile == nil {
+		profile = make(map[string]interface{})
+	}
+	for option, value := range options {
+		if value == nil {
+			delete(profile, option)
+		} else {
+			profile[option] = value
+		}
+	}
+	profiles[name] = profile
+
+	path, err = homedir.Expand(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to write configuration file: %s", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".config-*.toml")
+	if err != nil {
+		return fmt.Errorf("failed to write configuration file: %s", err)
+	}
+	err = toml.NewEncoder(f).Encode(config)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to write configuration file: %s", err)
+	}
+	return nil
+}
@@ -2,19 +2,35 @@ package params
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
+	"os"
 	"os/user"
 	"strings"
+	"time"
 )
 
 type SSHParams struct {
-	Port      int
-	Insecure  bool
-	LoginName string
-	Host      string
-	Commands  []string
-	HTTPProxy *url.URL
-	UseAgent  bool
+	Port                  int
+	Insecure              bool
+	LoginName             string
+	Host                  string
+	HostAlias             string
+	Commands              []string
+	Proxy                 *url.URL
+	ProxyFromEnv          bool
+	NoProxy               string
+	ProxySecret           string
+	UseAgent              bool
+	HostCAMount           string
+	RevokedHostKeys       string
+	ProxyJump             string
+	SSHConfigFile         string
+	Jumps                 []JumpHop
+	ServerAliveInterval   time.Duration
+	ServerAliveCountMax   int
+	StrictHostKeyChecking string
+	Vault                 VaultParams
 }
 
 func GetSSHParams(c CLIContext) (p SSHParams, err error) {
@@ -27,6 +43,24 @@ func GetSSHParams(c CLIContext) (p SSHParams, err error) {
 		p.LoginName = spl[0]
 		p.Host = spl[1]
 	}
+	mapping, err := c.HostMapping()
+	if err != nil {
+		return p, err
+	}
+	sshConfig, err := c.SSHConfig()
+	if err != nil {
+		return p, err
+	}
+	p.HostAlias = p.Host
+	if sshConfig.HostName != "" {
+		p.Host = sshConfig.HostName
+	}
+	if p.LoginName == "" {
+		p.LoginName = mapping.Login
+	}
+	if p.LoginName == "" {
+		p.LoginName = sshConfig.User
+	}
 	if p.LoginName == "" {
 		p.LoginName = c.SSHLogin()
 		if p.LoginName == "" {
@@ -41,8 +75,66 @@ func GetSSHParams(c CLIContext) (p SSHParams, err error) {
 	p.Insecure = c.SSHInsecure()
 	p.UseAgent = c.SSHAgent()
 	p.Port = c.SSHPort()
-	if c.HTTPProxy() != "" {
-		p.HTTPProxy, err = url.Parse(c.HTTPProxy())
+	if sshConfig.Port != 0 {
+		p.Port = sshConfig.Port
+	}
+	if mapping.Port != 0 {
+		p.Port = mapping.Port
+	}
+	p.ProxyJump = sshConfig.ProxyJump
+	if c.ProxyJump() != "" {
+		p.ProxyJump = c.ProxyJump()
 	}
+	p.ServerAliveInterval = sshConfig.ServerAliveInterval
+	p.ServerAliveCountMax = sshConfig.ServerAliveCountMax
+	if p.ServerAliveCountMax == 0 {
+		p.ServerAliveCountMax = 3
+	}
+	p.StrictHostKeyChecking = sshConfig.StrictHostKeyChecking
+	p.HostCAMount = c.VaultSSHHostMount()
+	p.RevokedHostKeys = c.RevokedHostKeys()
+	p.Vault = GetVaultParams(c)
+	p.Proxy, err = proxyURL(c.HTTPProxy())
+	p.ProxyFromEnv = p.Proxy != nil && strings.TrimSpace(c.HTTPProxy()) == ""
+	p.NoProxy = getenv("NO_PROXY", "no_proxy")
+	p.ProxySecret = c.ProxySecret()
+	p.SSHConfigFile = c.SSHConfigFile()
 	return p, err
 }
+
+// proxyURL parses the proxy URL. Without a proxy on the command line, the
+// ALL_PROXY environment variable is used.
+func proxyURL(s string) (*url.URL, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		s = getenv("ALL_PROXY", "all_proxy")
+	}
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL: no host")
+	}
+	return u, nil
+}
+
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,452 @@
+package params
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// DefaultSSHConfigFile is the default path of the OpenSSH client configuration.
+const DefaultSSHConfigFile = "~/.ssh/config"
+
+// SystemSSHConfigFile is the system-wide OpenSSH client configuration. It is
+// read after the user configuration, unless another file is given.
+const SystemSSHConfigFile = "/etc/ssh/ssh_config"
+
+const maxSSHConfigDepth = 16
+
+// SSHConfig holds the ssh_config options that vssh supports, for one host.
+// The zero values mean that the option was not set.
+type SSHConfig struct {
+	HostName              string
+	User                  string
+	Port                  int
+	IdentityFiles         []string
+	ProxyJump             string
+	ServerAliveInterval   time.Duration
+	ServerAliveCountMax   int
+	StrictHostKeyChecking string
+}
+
+// LookupSSHConfig reads the ssh_config files in order, and returns the
+// options for host. Like OpenSSH, the first obtained value of each option
+// wins, except for IdentityFile that accumulates. user is the remote user
+// given on the command line, if any. Missing files are skipped.
+func LookupSSHConfig(paths []string, host, user string) (SSHConfig, error) {
+	s := &sshConfigLookup{
+		originalHost: strings.ToLower(host),
+		cmdlineUser:  user,
+		seen:         make(map[string]bool),
+	}
+	for _, path := range paths {
+		if path == "" || strings.ToLower(path) == "none" {
+			continue
+		}
+		path, err := homedir.Expand(path)
+		if err != nil {
+			return SSHConfig{}, err
+		}
+		err = s.readFile(path, filepath.Clean(path) == SystemSSHConfigFile, 0)
+		if err != nil {
+			return SSHConfig{}, err
+		}
+	}
+	return s.result(), nil
+}
+
+type sshConfigLookup struct {
+	originalHost string
+	cmdlineUser  string
+	config       SSHConfig
+	seen         map[string]bool
+}
+
+func (s *sshConfigLookup) readFile(path string, system bool, depth int) error {
+	if depth > maxSSHConfigDepth {
+		return fmt.Errorf("too many nested includes in ssh_config: %s", path)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ssh_config: %s", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	active := true
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s line %d: %s", path, lineno, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "host":
+			active = matchPatternList(args, s.originalHost)
+		case "match":
+			active, err = s.match(args)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %s", path, lineno, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			for _, arg := range args {
+				err := s.include(arg, system, depth)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			if !active {
+				continue
+			}
+			err := s.set(keyword, args)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %s", path, lineno, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ssh_config: %s", err)
+	}
+	return nil
+}
+
+// include reads the files of an Include directive. Relative paths are
+// relative to ~/.ssh, or to /etc/ssh for the system configuration.
+func (s *sshConfigLookup) include(pattern string, system bool, depth int) error {
+	pattern, err := homedir.Expand(pattern)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(pattern) {
+		base := filepath.Dir(SystemSSHConfigFile)
+		if !system {
+			base, err = homedir.Expand("~/.ssh")
+			if err != nil {
+				return err
+			}
+		}
+		pattern = filepath.Join(base, pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid Include in ssh_config: %s", pattern)
+	}
+	for _, path := range paths {
+		err := s.readFile(path, system, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sshConfigLookup) set(keyword string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing argument for %s", keyword)
+	}
+	if keyword == "identityfile" {
+		s.config.IdentityFiles = append(s.config.IdentityFiles, args[0])
+		return nil
+	}
+	if s.seen[keyword] {
+		return nil
+	}
+	switch keyword {
+	case "hostname":
+		s.config.HostName = expandSSHTokens(args[0], map[byte]string{'h': s.originalHost})
+	case "user":
+		s.config.User = args[0]
+	case "port":
+		port, err := strconv.Atoi(args[0])
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port: %s", args[0])
+		}
+		s.config.Port = port
+	case "proxyjump":
+		s.config.ProxyJump = args[0]
+	case "serveraliveinterval":
+		interval, err := parseSSHConfigTime(args[0])
+		if err != nil {
+			return err
+		}
+		s.config.ServerAliveInterval = interval
+	case "serveralivecountmax":
+		count, err := strconv.Atoi(args[0])
+		if err != nil || count < 0 {
+			return fmt.Errorf("invalid ServerAliveCountMax: %s", args[0])
+		}
+		s.config.ServerAliveCountMax = count
+	case "stricthostkeychecking":
+		mode := strings.ToLower(args[0])
+		switch mode {
+		case "yes", "ask", "accept-new", "no":
+		case "off":
+			mode = "no"
+		default:
+			return fmt.Errorf("invalid StrictHostKeyChecking: %s", args[0])
+		}
+		s.config.StrictHostKeyChecking = mode
+	default:
+		// the other options are not used by vssh
+		return nil
+	}
+	s.seen[keyword] = true
+	return nil
+}
+
+// match evaluates the criteria of a Match line. All the criteria must match.
+func (s *sshConfigLookup) match(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, errors.New("missing Match criteria")
+	}
+	result := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+		var matched bool
+		switch criterion {
+		case "all", "canonical", "final":
+			// vssh reads the configuration once, without canonicalization
+			matched = true
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf("missing argument for Match %s", criterion)
+			}
+			i++
+			arg := args[i]
+			switch criterion {
+			case "host":
+				matched = matchPatternList(splitCommas(arg), s.hostName())
+			case "originalhost":
+				matched = matchPatternList(splitCommas(arg), s.originalHost)
+			case "user":
+				matched = matchPatternList(splitCommas(arg), s.remoteUser())
+			case "localuser":
+				matched = matchPatternList(splitCommas(arg), localUsername())
+			case "exec":
+				if result {
+					matched = s.exec(arg)
+				}
+			}
+		default:
+			return false, fmt.Errorf("unsupported Match criteria: %s", criterion)
+		}
+		if matched == negate {
+			result = false
+		}
+	}
+	return result, nil
+}
+
+func (s *sshConfigLookup) exec(command string) bool {
+	command = expandSSHTokens(command, s.tokens())
+	return exec.Command("/bin/sh", "-c", command).Run() == nil
+}
+
+func (s *sshConfigLookup) hostName() string {
+	if s.config.HostName != "" {
+		return strings.ToLower(s.config.HostName)
+	}
+	return s.originalHost
+}
+
+func (s *sshConfigLookup) remoteUser() string {
+	if s.cmdlineUser != "" {
+		return s.cmdlineUser
+	}
+	if s.config.User != "" {
+		return s.config.User
+	}
+	return localUsername()
+}
+
+func (s *sshConfigLookup) tokens() map[byte]string {
+	port := 22
+	if s.config.Port != 0 {
+		port = s.config.Port
+	}
+	home, _ := homedir.Dir()
+	localHost, _ := os.Hostname()
+	return map[byte]string{
+		'd': home,
+		'h': s.hostName(),
+		'l': localHost,
+		'L': strings.SplitN(localHost, ".", 2)[0],
+		'n': s.originalHost,
+		'p': strconv.Itoa(port),
+		'r': s.remoteUser(),
+		'u': localUsername(),
+	}
+}
+
+func (s *sshConfigLookup) result() SSHConfig {
+	tokens := s.tokens()
+	for i, path := range s.config.IdentityFiles {
+		s.config.IdentityFiles[i] = expandSSHTokens(path, tokens)
+	}
+	if strings.ToLower(s.config.ProxyJump) == "none" {
+		s.config.ProxyJump = ""
+	}
+	return s.config
+}
+
+// splitSSHConfigLine returns the lowercased keyword and the arguments of a
+// ssh_config line. The keyword may be separated from the arguments by an
+// equal sign, and arguments may be quoted.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	idx := strings.IndexAny(line, " \t=")
+	if idx == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:idx])
+	rest := strings.TrimLeft(line[idx:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	var args []string
+	for rest != "" {
+		if rest[0] == '#' {
+			break
+		}
+		var arg string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return "", nil, errors.New("unterminated quote")
+			}
+			arg = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end == -1 {
+				end = len(rest)
+			}
+			arg = rest[:end]
+			rest = rest[end:]
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return keyword, args, nil
+}
+
+// matchPatternList tells if s matches a list of ssh_config patterns: at least
+// one pattern must match, and no negated pattern.
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(pattern[1:], s) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(pattern, s) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern matches s against a pattern with the * and ? wildcards.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+func splitCommas(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' })
+}
+
+// expandSSHTokens replaces the %x tokens of ssh_config and expands the ~.
+func expandSSHTokens(s string, tokens map[byte]string) string {
+	if strings.HasPrefix(s, "~") {
+		if expanded, err := homedir.Expand(s); err == nil {
+			s = expanded
+		}
+	}
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if s[i] == '%' {
+			b.WriteByte('%')
+		} else if v, ok := tokens[s[i]]; ok {
+			b.WriteString(v)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// parseSSHConfigTime parses a ssh_config time value, either a number of
+// seconds or a duration like 1m30s.
+func parseSSHConfigTime(s string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(s); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid time value: %s", s)
+	}
+	return d, nil
+}
+
+func localUsername() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
@@ -0,0 +1,259 @@
+package params
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+		err     bool
+	}{
+		{line: "", keyword: ""},
+		{line: "   ", keyword: ""},
+		{line: "# comment", keyword: ""},
+		{line: "  # indented comment", keyword: ""},
+		{line: "Host web", keyword: "host", args: []string{"web"}},
+		{line: "HostName=example.org", keyword: "hostname", args: []string{"example.org"}},
+		{line: "Port = 2222", keyword: "port", args: []string{"2222"}},
+		{line: "\tUser\tbob", keyword: "user", args: []string{"bob"}},
+		{line: "Host web db *.example.org", keyword: "host", args: []string{"web", "db", "*.example.org"}},
+		{line: `IdentityFile "/path/with space/id"`, keyword: "identityfile", args: []string{"/path/with space/id"}},
+		{line: `Match exec "test -f /x" host web`, keyword: "match", args: []string{"exec", "test -f /x", "host", "web"}},
+		{line: "User bob # trailing comment", keyword: "user", args: []string{"bob"}},
+		{line: "Compression", keyword: "compression"},
+		{line: `IdentityFile "/unterminated`, err: true},
+	}
+	for _, test := range tests {
+		keyword, args, err := splitSSHConfigLine(test.line)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.line, err)
+			continue
+		}
+		if keyword != test.keyword || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q: got %q %q, want %q %q", test.line, keyword, args, test.keyword, test.args)
+		}
+	}
+}
+
+func TestMatchPatternList(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		s        string
+		want     bool
+	}{
+		{[]string{"web"}, "web", true},
+		{[]string{"web"}, "web2", false},
+		{[]string{"WEB"}, "web", true},
+		{[]string{"*"}, "anything", true},
+		{[]string{"*"}, "", true},
+		{[]string{"web*"}, "web", true},
+		{[]string{"web*"}, "web01.example.org", true},
+		{[]string{"*.example.org"}, "web.example.org", true},
+		{[]string{"*.example.org"}, "example.org", false},
+		{[]string{"web?"}, "web1", true},
+		{[]string{"web?"}, "web", false},
+		{[]string{"web?"}, "web12", false},
+		{[]string{"*b*c"}, "abxbc", true},
+		{[]string{"db", "web"}, "web", true},
+		{[]string{"*", "!web"}, "web", false},
+		{[]string{"*", "!web"}, "db", true},
+		{[]string{"!web", "*"}, "web", false},
+		{[]string{"!web"}, "db", false},
+		{[]string{}, "web", false},
+	}
+	for _, test := range tests {
+		if got := matchPatternList(test.patterns, test.s); got != test.want {
+			t.Errorf("matchPatternList(%q, %q) = %v, want %v", test.patterns, test.s, got, test.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	s := &sshConfigLookup{
+		originalHost: "web",
+		cmdlineUser:  "bob",
+		config:       SSHConfig{HostName: "web.example.org"},
+	}
+	tests := []struct {
+		args []string
+		want bool
+		err  bool
+	}{
+		{args: []string{"all"}, want: true},
+		{args: []string{"host", "web.example.org"}, want: true},
+		{args: []string{"host", "web"}, want: false},
+		{args: []string{"host", "db,*.example.org"}, want: true},
+		{args: []string{"originalhost", "web"}, want: true},
+		{args: []string{"originalhost", "web.example.org"}, want: false},
+		{args: []string{"user", "bob"}, want: true},
+		{args: []string{"user", "alice"}, want: false},
+		{args: []string{"!user", "alice"}, want: true},
+		{args: []string{"host", "*.example.org", "user", "alice"}, want: false},
+		{args: []string{"host", "*.example.org", "user", "bob"}, want: true},
+		{args: []string{"exec", "true"}, want: true},
+		{args: []string{"exec", "false"}, want: false},
+		{args: []string{"!exec", "false"}, want: true},
+		{args: []string{"exec", "test %h = web.example.org -a %n = web -a %r = bob"}, want: true},
+		{args: []string{"canonical", "host", "web.example.org"}, want: true},
+		{args: []string{}, err: true},
+		{args: []string{"host"}, err: true},
+		{args: []string{"address", "10.0.0.1"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := s.match(test.args)
+		if test.err {
+			if err == nil {
+				t.Errorf("Match %q: expected an error", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Match %q: unexpected error: %s", test.args, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Match %q = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+// writeSSHConfig writes the ssh_config files in a temporary directory, and
+// returns the directory. The occurrences of DIR are replaced by the directory.
+func writeSSHConfig(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "vssh-sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		content = strings.Replace(content, "DIR", dir, -1)
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLookupSSHConfig(t *testing.T) {
+	dir := writeSSHConfig(t, map[string]string{
+		"config": `
+# the first obtained value wins
+Host web
+    HostName %h.example.org
+    Port 2222
+    IdentityFile /keys/web
+
+Host web db
+    Port 2200
+    User alice
+    IdentityFile /keys/%r@%h
+
+Match host web.example.org
+    ServerAliveInterval 1m
+    StrictHostKeyChecking off
+
+Include DIR/included-*
+
+Host *
+    User bob
+    ProxyJump none
+`,
+		"included-1": `
+Host web
+    ServerAliveCountMax 5
+    ProxyJump bastion
+`,
+	})
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	config, err := LookupSSHConfig([]string{filepath.Join(dir, "config"), filepath.Join(dir, "missing")}, "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SSHConfig{
+		HostName:              "web.example.org",
+		User:                  "alice",
+		Port:                  2222,
+		IdentityFiles:         []string{"/keys/web", "/keys/alice@web.example.org"},
+		ProxyJump:             "bastion",
+		ServerAliveInterval:   time.Minute,
+		ServerAliveCountMax:   5,
+		StrictHostKeyChecking: "no",
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("web: got %+v, want %+v", config, want)
+	}
+
+	config, err = LookupSSHConfig([]string{filepath.Join(dir, "config")}, "other", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = SSHConfig{User: "bob"}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("other: got %+v, want %+v", config, want)
+	}
+}
+
+func TestLookupSSHConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"bad port":        "Port http\n",
+		"bad time":        "ServerAliveInterval soon\n",
+		"missing arg":     "User\n",
+		"bad match":       "Match address 10.0.0.1\n",
+		"bad quote":       "User \"bob\n",
+		"include loop":    "Include DIR/config\n",
+		"bad strict mode": "StrictHostKeyChecking maybe\n",
+	}
+	for name, content := range tests {
+		dir := writeSSHConfig(t, map[string]string{"config": content})
+		_, err := LookupSSHConfig([]string{filepath.Join(dir, "config")}, "web", "")
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestIncludeDepth(t *testing.T) {
+	// each file includes the next one, up to the maximum depth
+	files := make(map[string]string)
+	for i := 0; i <= maxSSHConfigDepth; i++ {
+		files[filepath.Base(includeName(i))] = "Include DIR/" + filepath.Base(includeName(i+1)) + "\n"
+	}
+	files[filepath.Base(includeName(maxSSHConfigDepth+1))] = "User deep\n"
+
+	dir := writeSSHConfig(t, files)
+	defer func() { _ = os.RemoveAll(dir) }()
+	_, err := LookupSSHConfig([]string{filepath.Join(dir, includeName(0))}, "web", "")
+	if err == nil || !strings.Contains(err.Error(), "too many nested includes") {
+		t.Errorf("expected a nesting error, got %v", err)
+	}
+
+	config, err := LookupSSHConfig([]string{filepath.Join(dir, includeName(1))}, "web", "")
+	if err != nil {
+		t.Fatalf("unexpected error at the maximum depth: %s", err)
+	}
+	if config.User != "deep" {
+		t.Errorf("got user %q, want deep", config.User)
+	}
+}
+
+func includeName(i int) string {
+	return "config-" + string(rune('a'+i))
+}
@@ -0,0 +1,29 @@
+package sys
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Detach detaches the process from the terminal, like a daemon: the process
+// gets a new session, and stdin, stdout and stderr are redirected to
+// /dev/null.
+func Detach() error {
+	_, err := unix.Setsid()
+	if err != nil {
+		return err
+	}
+	devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = devnull.Close() }()
+	for _, fd := range []int{0, 1, 2} {
+		err = unix.Dup2(int(devnull.Fd()), fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
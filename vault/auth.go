@@ -0,0 +1,359 @@
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/consts"
+	"github.com/mitchellh/go-homedir"
+	vexec "github.com/stephane-martin/vault-exec/lib"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+)
+
+// DefaultKubernetesTokenFile is where Kubernetes mounts the service account token in pods.
+const DefaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// oidcTimeout is how long we wait for the user to complete the OIDC login in the browser.
+const oidcTimeout = 5 * time.Minute
+
+// Auth authenticates to Vault. The missing credentials are asked on the
+// terminal, like vault-exec does.
+func Auth(ctx context.Context, vaultParams params.VaultParams, l *zap.SugaredLogger) (*api.Client, error) {
+	client, err := newClient(vaultParams)
+	if err != nil {
+		return nil, err
+	}
+	// the login requests must not carry a token from the environment
+	client.ClearToken()
+
+	path := vaultParams.AuthPath
+	role := vaultParams.AuthRole
+	var secret *api.Secret
+
+	switch vaultParams.AuthMethod {
+	case "token":
+		l.Debug("token based authentication")
+		token, err := readToken(vaultParams.Token, l)
+		if err != nil {
+			return nil, err
+		}
+		client.SetToken(token)
+		return client, nil
+
+	case "userpass", "ldap":
+		l.Debugw("username based authentication", "method", vaultParams.AuthMethod)
+		var username, password string
+		username, password, err = readCredentials(vaultParams, "username", "password")
+		if err != nil {
+			return nil, err
+		}
+		secret, err = write(ctx, client, fmt.Sprintf("auth/%s/login/%s", path, username), map[string]interface{}{
+			"password": password,
+		})
+
+	case "approle":
+		l.Debug("approle based authentication")
+		var roleID, secretID string
+		roleID, secretID, err = readCredentials(vaultParams, "RoleID", "SecretID")
+		if err != nil {
+			return nil, err
+		}
+		secret, err = write(ctx, client, fmt.Sprintf("auth/%s/login", path), map[string]interface{}{
+			"role_id":   roleID,
+			"secret_id": secretID,
+		})
+
+	case "jwt":
+		l.Debug("JWT based authentication")
+		if vaultParams.JWT == "" {
+			return nil, errors.New("no JWT given for jwt authentication")
+		}
+		if role == "" {
+			return nil, errors.New("the role is needed for jwt authentication")
+		}
+		secret, err = write(ctx, client, fmt.Sprintf("auth/%s/login", path), map[string]interface{}{
+			"role": role,
+			"jwt":  vaultParams.JWT,
+		})
+
+	case "kubernetes":
+		l.Debug("kubernetes based authentication")
+		if role == "" {
+			return nil, errors.New("the role is needed for kubernetes authentication")
+		}
+		tokenFile := vaultParams.KubernetesTokenFile
+		if tokenFile == "" {
+			tokenFile = DefaultKubernetesTokenFile
+		}
+		var jwt []byte
+		jwt, err = ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kubernetes service account token: %s", err)
+		}
+		secret, err = write(ctx, client, fmt.Sprintf("auth/%s/login", path), map[string]interface{}{
+			"role": role,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		})
+
+	case "cert":
+		l.Debug("TLS certificate based authentication")
+		if vaultParams.ClientCert == "" {
+			return nil, errors.New("no client certificate given for cert authentication")
+		}
+		options := map[string]interface{}{}
+		if role != "" {
+			options["name"] = role
+		}
+		secret, err = write(ctx, client, fmt.Sprintf("auth/%s/login", path), options)
+
+	case "oidc":
+		l.Debug("OIDC based authentication")
+		secret, err = oidcLogin(ctx, client, vaultParams, l)
+
+	default:
+		return nil, fmt.Errorf("unknown auth type: %s", vaultParams.AuthMethod)
+	}
+	if err != nil {
+		if err == context.Canceled {
+			return nil, err
+		}
+		return nil, fmt.Errorf("vault auth error: %s", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, errors.New("vault auth error: no token in Vault response")
+	}
+	client.SetToken(secret.Auth.ClientToken)
+	return client, nil
+}
+
+// newClient creates a Vault client without authentication, configured with
+// the TLS and namespace parameters.
+func newClient(vaultParams params.VaultParams) (*api.Client, error) {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, fmt.Errorf("error creating vault client: %s", config.Error)
+	}
+	config.Address = vaultParams.Address
+	tlsConfig := &api.TLSConfig{
+		CACert:        vaultParams.CACert,
+		CAPath:        vaultParams.CAPath,
+		ClientCert:    vaultParams.ClientCert,
+		ClientKey:     vaultParams.ClientKey,
+		TLSServerName: vaultParams.TLSServerName,
+		Insecure:      vaultParams.SkipVerify,
+	}
+	for _, p := range []*string{&tlsConfig.CACert, &tlsConfig.CAPath, &tlsConfig.ClientCert, &tlsConfig.ClientKey} {
+		expanded, err := homedir.Expand(*p)
+		if err != nil {
+			return nil, err
+		}
+		*p = expanded
+	}
+	err := config.ConfigureTLS(tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vault TLS configuration: %s", err)
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault client: %s", err)
+	}
+	if vaultParams.Namespace != "" {
+		client.SetNamespace(vaultParams.Namespace)
+	} else {
+		// NewClient reads VAULT_NAMESPACE
+		headers := client.Headers()
+		headers.Del(consts.NamespaceHeaderName)
+		client.SetHeaders(headers)
+	}
+	return client, nil
+}
+
+// readToken returns token, or else the token typed on the terminal. The
+// stored token has already been looked up with the token helper, that is
+// keyed by the Vault server.
+func readToken(token string, l *zap.SugaredLogger) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	l.Debug("token not found on command line, env or token helper")
+	t, err := vexec.Input("enter token: ", true)
+	if err != nil {
+		return "", fmt.Errorf("error reading token: %s", err)
+	}
+	if len(t) == 0 {
+		return "", errors.New("empty token")
+	}
+	return string(t), nil
+}
+
+// readCredentials returns the username and the password of vaultParams. The
+// missing ones are typed on the terminal.
+func readCredentials(vaultParams params.VaultParams, usernameName, passwordName string) (string, string, error) {
+	username, password := vaultParams.Username, vaultParams.Password
+	if username == "" {
+		u, err := vexec.Input(fmt.Sprintf("enter %s: ", usernameName), false)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading %s: %s", usernameName, err)
+		}
+		if len(u) == 0 {
+			return "", "", fmt.Errorf("empty %s", usernameName)
+		}
+		username = string(u)
+	}
+	if password == "" {
+		p, err := vexec.Input(fmt.Sprintf("enter %s: ", passwordName), true)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading %s: %s", passwordName, err)
+		}
+		if len(p) == 0 {
+			return "", "", fmt.Errorf("empty %s", passwordName)
+		}
+		password = string(p)
+	}
+	return username, password, nil
+}
+
+func write(ctx context.Context, client *api.Client, path string, data map[string]interface{}) (*api.Secret, error) {
+	r := client.NewRequest("PUT", "/v1/"+path)
+	err := r.SetJSONBody(data)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return api.ParseSecret(resp.Body)
+}
+
+type oidcResult struct {
+	secret *api.Secret
+	err    error
+}
+
+// oidcLogin runs the OIDC authorization code flow: the user logs in with the
+// browser, and the identity provider redirects the browser to a listener on
+// the loopback interface.
+func oidcLogin(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) (*api.Secret, error) {
+	port := vaultParams.OIDCPort
+	if port == 0 {
+		port = 8250
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the OIDC callback: %s", err)
+	}
+	defer func() { _ = listener.Close() }()
+	redirectURI := fmt.Sprintf("http://localhost:%d/oidc/callback", port)
+
+	nonceb := make([]byte, 16)
+	_, err = rand.Read(nonceb)
+	if err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(nonceb)
+
+	secret, err := write(ctx, client, fmt.Sprintf("auth/%s/oidc/auth_url", vaultParams.AuthPath), map[string]interface{}{
+		"role":         vaultParams.AuthRole,
+		"redirect_uri": redirectURI,
+		"client_nonce": nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var authURL string
+	if secret != nil {
+		authURL, _ = secret.Data["auth_url"].(string)
+	}
+	if authURL == "" {
+		return nil, fmt.Errorf("no OIDC authorization URL from Vault, check that %s is an allowed redirect URI for the role", redirectURI)
+	}
+
+	results := make(chan oidcResult, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/oidc/callback" {
+				http.NotFound(w, req)
+				return
+			}
+			var res oidcResult
+			q := req.URL.Query()
+			if e := q.Get("error"); e != "" {
+				res.err = fmt.Errorf("OIDC error: %s %s", e, q.Get("error_description"))
+			} else {
+				r := client.NewRequest("GET", fmt.Sprintf("/v1/auth/%s/oidc/callback", vaultParams.AuthPath))
+				r.Params.Set("state", q.Get("state"))
+				r.Params.Set("code", q.Get("code"))
+				r.Params.Set("id_token", q.Get("id_token"))
+				r.Params.Set("client_nonce", nonce)
+				resp, err := client.RawRequestWithContext(ctx, r)
+				if err == nil {
+					res.secret, res.err = api.ParseSecret(resp.Body)
+				} else {
+					res.err = err
+				}
+				if resp != nil {
+					_ = resp.Body.Close()
+				}
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if res.err == nil {
+				fmt.Fprint(w, "<html><body>Vault login successful. You can close this window.</body></html>")
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "<html><body>Vault login failed: %s</body></html>", html.EscapeString(res.err.Error()))
+			}
+			select {
+			case results <- res:
+			default:
+			}
+		}),
+	}
+	go func() { _ = server.Serve(listener) }()
+	defer func() { _ = server.Close() }()
+
+	fmt.Fprintf(os.Stderr, "Complete the login with your browser. If it does not open automatically, open this URL:\n\n    %s\n\n", authURL)
+	err = openBrowser(authURL)
+	if err != nil {
+		l.Debugw("failed to open browser", "error", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(oidcTimeout):
+		return nil, errors.New("timeout waiting for the OIDC callback")
+	case res := <-results:
+		return res.secret, res.err
+	}
+}
+
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Start()
+}
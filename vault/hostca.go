@@ -0,0 +1,97 @@
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+const hostCADir = "~/.config/vssh/hostca"
+
+// HostCAMaxAge is how long the host CA public key fetched from Vault is
+// cached on disk before it is fetched again.
+const HostCAMaxAge = 24 * time.Hour
+
+// GetHostCA returns the public key of the Vault SSH host signer mounted at
+// mount. The key is cached on disk. If Vault can't be reached, an expired
+// cached key is used.
+func GetHostCA(ctx context.Context, vaultParams params.VaultParams, mount string, l *zap.SugaredLogger) (ssh.PublicKey, error) {
+	dir, err := homedir.Expand(hostCADir)
+	if err != nil {
+		return nil, err
+	}
+	cachePath := filepath.Join(dir, hostCAName(vaultParams, mount))
+
+	var cached ssh.PublicKey
+	infos, err := os.Stat(cachePath)
+	if err == nil {
+		content, err := ioutil.ReadFile(cachePath)
+		if err == nil {
+			cached, _, _, _, err = ssh.ParseAuthorizedKey(content)
+		}
+		if err != nil {
+			l.Warnw("failed to read cached host CA", "error", err)
+			cached = nil
+		} else if time.Since(infos.ModTime()) < HostCAMaxAge {
+			return cached, nil
+		}
+	}
+
+	content, err := readHostCA(ctx, vaultParams, mount)
+	if err == nil {
+		var key ssh.PublicKey
+		key, _, _, _, err = ssh.ParseAuthorizedKey(content)
+		if err == nil {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				l.Warnw("failed to create host CA cache directory", "error", err)
+			} else if err := ioutil.WriteFile(cachePath, ssh.MarshalAuthorizedKey(key), 0600); err != nil {
+				l.Warnw("failed to cache host CA", "error", err)
+			}
+			return key, nil
+		}
+	}
+	if err == context.Canceled {
+		return nil, err
+	}
+	if cached != nil {
+		l.Warnw("failed to fetch host CA from vault, using cached host CA", "error", err)
+		return cached, nil
+	}
+	return nil, fmt.Errorf("failed to fetch host CA from vault: %s", err)
+}
+
+// hostCAName returns the name of the cache file of a host CA. Equivalent
+// addresses and namespaces share the same file, like for the tokens.
+func hostCAName(vaultParams params.VaultParams, mount string) string {
+	h := sha256.Sum256([]byte(NormalizeAddress(vaultParams.Address) + "\x00" + strings.Trim(vaultParams.Namespace, "/") + "\x00" + strings.Trim(mount, "/")))
+	return hex.EncodeToString(h[:]) + ".pub"
+}
+
+// readHostCA reads the public key of the host signer. The public_key endpoint
+// does not need authentication.
+func readHostCA(ctx context.Context, vaultParams params.VaultParams, mount string) ([]byte, error) {
+	client, err := newClient(vaultParams)
+	if err != nil {
+		return nil, err
+	}
+	client.ClearToken()
+	resp, err := client.RawRequestWithContext(ctx, client.NewRequest("GET", fmt.Sprintf("/v1/%s/public_key", mount)))
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,27 @@
+package vault
+
+import (
+	"testing"
+
+	"github.com/stephane-martin/vssh/params"
+)
+
+func TestHostCAName(t *testing.T) {
+	base := hostCAName(params.VaultParams{Address: "https://vault:8200", Namespace: "team"}, "ssh-host")
+	tests := []struct {
+		address, namespace, mount string
+		same                      bool
+	}{
+		{"https://vault:8200", "team", "ssh-host", true},
+		{" https://VAULT:8200/ ", "/team/", "/ssh-host/", true},
+		{"https://vault:8200", "", "ssh-host", false},
+		{"https://other:8200", "team", "ssh-host", false},
+		{"https://vault:8200", "team", "ssh-host2", false},
+	}
+	for _, test := range tests {
+		got := hostCAName(params.VaultParams{Address: test.address, Namespace: test.namespace}, test.mount)
+		if (got == base) != test.same {
+			t.Errorf("hostCAName(%q, %q, %q) = %s, same = %v", test.address, test.namespace, test.mount, got, !test.same)
+		}
+	}
+}
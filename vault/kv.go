@@ -0,0 +1,148 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+)
+
+// SecretPath is a path to a secret in Vault, with an optional version and
+// field: path[@version][#field].
+type SecretPath struct {
+	Path    string
+	Version int
+	Field   string
+}
+
+// ParseSecretPath parses a secret path like secret/keys@3#id_ed25519. An @
+// that is not followed by digits is part of the path, like in
+// secret/alice@example.org.
+func ParseSecretPath(s string) (p SecretPath, err error) {
+	s = strings.Trim(strings.TrimSpace(s), "/")
+	if idx := strings.LastIndex(s, "#"); idx != -1 {
+		p.Field = s[idx+1:]
+		s = s[:idx]
+		if p.Field == "" {
+			return p, fmt.Errorf("empty field in secret path: %s#", s)
+		}
+	}
+	if idx := strings.LastIndex(s, "@"); idx != -1 && idx > strings.LastIndex(s, "/") && isVersion(s[idx+1:]) {
+		p.Version, err = strconv.Atoi(s[idx+1:])
+		if err != nil || p.Version <= 0 {
+			return p, fmt.Errorf("invalid version in secret path: %s", s)
+		}
+		s = s[:idx]
+	}
+	p.Path = strings.Trim(s, "/")
+	if p.Path == "" {
+		return p, fmt.Errorf("empty secret path")
+	}
+	return p, nil
+}
+
+// isVersion returns true if s looks like a version: digits, or nothing.
+func isVersion(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// kvMount returns the mount point and the version of the KV secrets engine
+// that serves path. If the mount can't be determined, KV v1 is assumed.
+func kvMount(ctx context.Context, client *api.Client, path string, l *zap.SugaredLogger) (string, int) {
+	r := client.NewRequest("GET", "/v1/sys/internal/ui/mounts/"+path)
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil {
+		// older Vault servers don't have this endpoint, and it is only
+		// available for the paths that the token can access
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			l.Debugw("failed to look up KV mount, assuming KV v1", "path", path, "error", err)
+		}
+		return "", 1
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil || secret == nil || secret.Data == nil {
+		return "", 1
+	}
+	mount, _ := secret.Data["path"].(string)
+	options, _ := secret.Data["options"].(map[string]interface{})
+	if options == nil {
+		return mount, 1
+	}
+	if version, _ := options["version"].(string); version == "2" {
+		return mount, 2
+	}
+	return mount, 1
+}
+
+// ReadSecret reads a secret from a KV v1 or KV v2 secrets engine. The KV
+// version is detected automatically. It returns nil if the secret does not
+// exist.
+func ReadSecret(ctx context.Context, client *api.Client, p SecretPath, l *zap.SugaredLogger) (map[string]string, error) {
+	mount, version := kvMount(ctx, client, p.Path, l)
+	apiPath := "/v1/" + p.Path
+	if version == 2 {
+		mount = strings.Trim(mount, "/")
+		rest := strings.TrimPrefix(strings.TrimPrefix(p.Path, mount), "/")
+		apiPath = fmt.Sprintf("/v1/%s/data/%s", mount, rest)
+	} else if p.Version != 0 {
+		return nil, fmt.Errorf("%s is not in a KV v2 secrets engine, versions are not supported", p.Path)
+	}
+	r := client.NewRequest("GET", apiPath)
+	if p.Version != 0 {
+		r.Params.Set("version", strconv.Itoa(p.Version))
+	}
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret from vault: %s", err)
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret from vault: %s", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	data := secret.Data
+	if version == 2 {
+		// deleted or destroyed versions have no data
+		data, _ = secret.Data["data"].(map[string]interface{})
+		if data == nil {
+			return nil, nil
+		}
+	}
+	l.Debugw("secret read from vault", "path", p.Path, "kv_version", version)
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			values[k] = s
+		} else if v != nil {
+			values[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	if p.Field != "" {
+		v, ok := values[p.Field]
+		if !ok {
+			return nil, fmt.Errorf("field %s not found in secret %s", p.Field, p.Path)
+		}
+		return map[string]string{p.Field: v}, nil
+	}
+	return values, nil
+}
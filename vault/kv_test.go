@@ -0,0 +1,140 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+)
+
+func TestParseSecretPath(t *testing.T) {
+	tests := []struct {
+		s    string
+		want SecretPath
+		err  bool
+	}{
+		{s: "secret/app", want: SecretPath{Path: "secret/app"}},
+		{s: " /secret/app/ ", want: SecretPath{Path: "secret/app"}},
+		{s: "secret/app@3", want: SecretPath{Path: "secret/app", Version: 3}},
+		{s: "secret/app#password", want: SecretPath{Path: "secret/app", Field: "password"}},
+		{s: "secret/app@3#password", want: SecretPath{Path: "secret/app", Version: 3, Field: "password"}},
+		{s: "a@b#c", want: SecretPath{Path: "a@b", Field: "c"}},
+		{s: "secret/alice@example.org", want: SecretPath{Path: "secret/alice@example.org"}},
+		{s: "secret/alice@example.org@2", want: SecretPath{Path: "secret/alice@example.org", Version: 2}},
+		{s: "secret/user@host/key", want: SecretPath{Path: "secret/user@host/key"}},
+		{s: "secret/user@2/key", want: SecretPath{Path: "secret/user@2/key"}},
+		{s: "secret/app@1#a#b", want: SecretPath{Path: "secret/app@1#a", Field: "b"}},
+		{s: "secret/app@0", err: true},
+		{s: "secret/app@", err: true},
+		{s: "secret/app@99999999999999999999", err: true},
+		{s: "secret/app#", err: true},
+		{s: "secret/app@3#", err: true},
+		{s: "", err: true},
+		{s: "/", err: true},
+		{s: "@3", err: true},
+		{s: "#field", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseSecretPath(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseSecretPath(%q): expected an error, got %+v", test.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSecretPath(%q): unexpected error: %s", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseSecretPath(%q) = %+v, want %+v", test.s, got, test.want)
+		}
+	}
+}
+
+// fakeKV serves a KV v1 engine at secret/ and a KV v2 engine at kv/.
+func fakeKV() *httptest.Server {
+	reply := func(w http.ResponseWriter, data interface{}) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/kv/"):
+			reply(w, map[string]interface{}{"path": "kv/", "type": "kv", "options": map[string]interface{}{"version": "2"}})
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/"):
+			reply(w, map[string]interface{}{"path": "secret/", "type": "kv", "options": nil})
+		case r.URL.Path == "/v1/secret/app":
+			reply(w, map[string]interface{}{"user": "alice", "port": 22})
+		case r.URL.Path == "/v1/kv/data/app":
+			version := r.URL.Query().Get("version")
+			if version == "" {
+				version = "2"
+			}
+			if version == "1" {
+				// a deleted version
+				reply(w, map[string]interface{}{"data": nil, "metadata": map[string]interface{}{"version": 1}})
+				return
+			}
+			reply(w, map[string]interface{}{"data": map[string]interface{}{"user": "bob", "version": version}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestReadSecret(t *testing.T) {
+	server := fakeKV()
+	defer server.Close()
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("token")
+	l := zap.NewNop().Sugar()
+
+	tests := []struct {
+		path string
+		want map[string]string
+		err  bool
+	}{
+		{path: "secret/app", want: map[string]string{"user": "alice", "port": "22"}},
+		{path: "secret/app#user", want: map[string]string{"user": "alice"}},
+		{path: "secret/missing", want: nil},
+		{path: "secret/app@2", err: true},
+		{path: "secret/app#password", err: true},
+		{path: "kv/app", want: map[string]string{"user": "bob", "version": "2"}},
+		{path: "kv/app@3", want: map[string]string{"user": "bob", "version": "3"}},
+		{path: "kv/app@3#version", want: map[string]string{"version": "3"}},
+		{path: "kv/app@1", want: nil},
+		{path: "kv/missing", want: nil},
+	}
+	for _, test := range tests {
+		p, err := ParseSecretPath(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadSecret(context.Background(), client, p, l)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.path, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
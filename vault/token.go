@@ -0,0 +1,268 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/mitchellh/go-homedir"
+	"go.uber.org/zap"
+)
+
+const defaultTokenFile = "~/.vault-token"
+const defaultVaultConfig = "~/.vault"
+
+// TokenHelper stores the Vault token between runs, the same way as the vault CLI.
+type TokenHelper interface {
+	Get() (string, error)
+	Store(token string) error
+	Erase() error
+}
+
+// the Vault server that the vault CLI uses, and that ~/.vault-token belongs to
+var cliAddress, cliNamespace = os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_NAMESPACE")
+
+// GetTokenHelper returns the token helper executable at path, for the Vault
+// server at address and the namespace. If path is empty, the token helper
+// configured in the vault CLI configuration file is used, or else the token
+// is stored in a file.
+//
+// A token must never be sent to another Vault server than the one that
+// issued it. The token helper executables are given the address and the
+// namespace with VAULT_ADDR and VAULT_NAMESPACE, like with the vault CLI.
+// The files are named after the address and the namespace. ~/.vault-token,
+// written by the vault CLI, is only read for the server of the VAULT_ADDR
+// and VAULT_NAMESPACE environment variables.
+func GetTokenHelper(path, address, namespace string) (TokenHelper, error) {
+	if path == "" {
+		p, err := tokenHelperFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+	if path == "" {
+		cliPath, err := homedir.Expand(defaultTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		h := fileTokenHelper{path: tokenFileFor(cliPath, address, namespace)}
+		if sameServer(address, namespace, cliAddress, cliNamespace) {
+			h.cliPath = cliPath
+		}
+		return h, nil
+	}
+	p, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	return externalTokenHelper{
+		binary: p,
+		env:    []string{"VAULT_ADDR=" + address, "VAULT_NAMESPACE=" + namespace},
+	}, nil
+}
+
+// NormalizeAddress returns the canonical form of a Vault address, so that
+// addresses can be compared.
+func NormalizeAddress(address string) string {
+	return strings.TrimRight(strings.ToLower(strings.TrimSpace(address)), "/")
+}
+
+func sameServer(address1, namespace1, address2, namespace2 string) bool {
+	return address1 != "" &&
+		NormalizeAddress(address1) == NormalizeAddress(address2) &&
+		strings.Trim(namespace1, "/") == strings.Trim(namespace2, "/")
+}
+
+// tokenFileFor returns the token file for the Vault server at address and
+// the namespace, next to cliPath.
+func tokenFileFor(cliPath, address, namespace string) string {
+	h := sha256.Sum256([]byte(NormalizeAddress(address) + "\x00" + strings.Trim(namespace, "/")))
+	return cliPath + "-" + hex.EncodeToString(h[:8])
+}
+
+func tokenHelperFromConfig() (string, error) {
+	path := os.Getenv("VAULT_CONFIG_PATH")
+	if path == "" {
+		path = defaultVaultConfig
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault configuration: %s", err)
+	}
+	var config struct {
+		TokenHelper string `hcl:"token_helper"`
+	}
+	err = hcl.Unmarshal(content, &config)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse vault configuration: %s", err)
+	}
+	return config.TokenHelper, nil
+}
+
+// fileTokenHelper stores the token in path. The token of the vault CLI in
+// cliPath is used when there is no token in path.
+type fileTokenHelper struct {
+	path    string
+	cliPath string
+}
+
+func readTokenFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (h fileTokenHelper) Get() (string, error) {
+	token, err := readTokenFile(h.path)
+	if err != nil || token != "" || h.cliPath == "" {
+		return token, err
+	}
+	return readTokenFile(h.cliPath)
+}
+
+func (h fileTokenHelper) Store(token string) error {
+	f, err := ioutil.TempFile(filepath.Dir(h.path), ".vault-token")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(token)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), h.path)
+}
+
+func (h fileTokenHelper) Erase() error {
+	err := os.Remove(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// externalTokenHelper runs a token helper executable, with the get, store or
+// erase argument.
+type externalTokenHelper struct {
+	binary string
+	env    []string
+}
+
+func (h externalTokenHelper) run(arg string, stdin string) (string, error) {
+	cmd := exec.Command(h.binary, arg)
+	cmd.Env = append(os.Environ(), h.env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("token helper %s failed: %s: %s", arg, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (h externalTokenHelper) Get() (string, error) {
+	token, err := h.run("get", "")
+	return strings.TrimSpace(token), err
+}
+
+func (h externalTokenHelper) Store(token string) error {
+	_, err := h.run("store", token)
+	return err
+}
+
+func (h externalTokenHelper) Erase() error {
+	_, err := h.run("erase", "")
+	return err
+}
+
+// RefreshToken looks up the client token, and renews it when less than a
+// third of its TTL remains. It returns an error if the token is not valid
+// anymore.
+func RefreshToken(ctx context.Context, client *api.Client, l *zap.SugaredLogger) error {
+	secret, err := tokenRequest(ctx, client, "GET", "/v1/auth/token/lookup-self")
+	if err != nil {
+		return err
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return err
+	}
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return err
+	}
+	// without a creation TTL, the token is not renewed
+	creationTTL, _ := parseutil.ParseDurationSecond(secret.Data["creation_ttl"])
+	l.Debugw("vault token looked up", "ttl", ttl, "creation_ttl", creationTTL, "renewable", renewable)
+	if !renewable || ttl == 0 || ttl > creationTTL/3 {
+		return nil
+	}
+	secret, err = tokenRequest(ctx, client, "PUT", "/v1/auth/token/renew-self")
+	if err != nil {
+		// the token is still valid, the renewal is not mandatory
+		l.Warnw("failed to renew vault token", "error", err)
+		return nil
+	}
+	if secret.Auth != nil {
+		l.Debugw("vault token renewed", "ttl", secret.Auth.LeaseDuration)
+	}
+	return nil
+}
+
+func tokenRequest(ctx context.Context, client *api.Client, method, path string) (*api.Secret, error) {
+	r := client.NewRequest(method, path)
+	if method == "PUT" {
+		err := r.SetJSONBody(map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("empty response from Vault for %s", path)
+	}
+	return secret, nil
+}
@@ -0,0 +1,90 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+func TestSameServer(t *testing.T) {
+	tests := []struct {
+		address1, namespace1 string
+		address2, namespace2 string
+		want                 bool
+	}{
+		{"https://vault:8200", "", "https://vault:8200", "", true},
+		{"https://vault:8200/", "", "https://VAULT:8200", "", true},
+		{"https://vault:8200", "team/", "https://vault:8200", "/team", true},
+		{"https://vault:8200", "team", "https://vault:8200", "", false},
+		{"https://vault:8200", "", "https://other:8200", "", false},
+		{"", "", "", "", false},
+	}
+	for _, test := range tests {
+		got := sameServer(test.address1, test.namespace1, test.address2, test.namespace2)
+		if got != test.want {
+			t.Errorf("sameServer(%q, %q, %q, %q) = %v, want %v", test.address1, test.namespace1, test.address2, test.namespace2, got, test.want)
+		}
+	}
+}
+
+func TestFileTokenHelper(t *testing.T) {
+	home, err := ioutil.TempDir("", "vssh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(home) }()
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("VAULT_CONFIG_PATH", os.Getenv("VAULT_CONFIG_PATH"))
+	_ = os.Setenv("HOME", home)
+	_ = os.Setenv("VAULT_CONFIG_PATH", filepath.Join(home, "missing"))
+	homedir.DisableCache = true
+	defer func() { homedir.DisableCache = false }()
+	defer func(address, namespace string) { cliAddress, cliNamespace = address, namespace }(cliAddress, cliNamespace)
+	cliAddress, cliNamespace = "https://a:8200", ""
+
+	err = ioutil.WriteFile(filepath.Join(home, ".vault-token"), []byte("cli-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the token of the vault CLI is only used for its own server
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"https://a:8200/", "cli-token"},
+		{"https://b:8200", ""},
+	}
+	for _, test := range tests {
+		h, err := GetTokenHelper("", test.address, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := h.Get()
+		if err != nil || got != test.want {
+			t.Errorf("%s: got token %q, %v, want %q", test.address, got, err, test.want)
+		}
+	}
+
+	// the stored tokens are keyed by server
+	a, _ := GetTokenHelper("", "https://a:8200", "")
+	b, _ := GetTokenHelper("", "https://b:8200", "")
+	if err := b.Store("b-token"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.Get(); got != "cli-token" {
+		t.Errorf("server a: got token %q, want cli-token", got)
+	}
+	if got, _ := b.Get(); got != "b-token" {
+		t.Errorf("server b: got token %q, want b-token", got)
+	}
+	if err := b.Erase(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.Get(); got != "" {
+		t.Errorf("server b: got token %q after erase", got)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"fmt"
 	"github.com/awnumar/memguard"
 	"github.com/stephane-martin/vssh/params"
-	"os"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/vault/api"
@@ -15,61 +15,166 @@ import (
 	"go.uber.org/zap"
 )
 
+// GetSecretsFromVault reads the secrets at the given paths, and returns them
+// as environment variables. The paths may pin a KV v2 version and select a
+// field: path[@version][#field].
 func GetSecretsFromVault(ctx context.Context, client *api.Client, keys []string, prefix, upcase bool, l *zap.SugaredLogger) (map[string]string, error) {
-	c := make(chan map[string]string, 1)
-	var err error
-	lCtx, lCancel := context.WithCancel(ctx)
-	go func() {
-		err = vexec.GetSecrets(
-			lCtx,
-			client,
-			prefix, upcase, true,
-			keys,
-			l,
-			c,
-		)
-		close(c)
-	}()
-	secrets := <-c
-	lCancel()
-	return secrets, err
+	result := make(map[string]string)
+	for _, key := range keys {
+		p, err := ParseSecretPath(key)
+		if err != nil {
+			return nil, err
+		}
+		values, err := ReadSecret(ctx, client, p, l)
+		if err != nil {
+			return nil, err
+		}
+		if values == nil {
+			l.Warnw("secret not found in vault", "path", key)
+			continue
+		}
+		for k, v := range values {
+			if prefix {
+				k = p.Path + "_" + k
+			}
+			k = vexec.Sanitize(k)
+			if upcase {
+				k = strings.ToUpper(k)
+			}
+			result[k] = v
+		}
+	}
+	return result, nil
 }
 
+// privateKeyField is the field of the private key, when a secret has several
+// fields.
+const privateKeyField = "private_key"
+
+// ReadPrivateKeyFromVault reads a SSH private key from Vault. If the secret
+// has several fields, the private key is the field given with
+// path[@version]#field, or else the private_key field, or else the only
+// field that holds a PEM private key.
 func ReadPrivateKeyFromVault(ctx context.Context, vpath string, client *api.Client, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
-	m, err := GetSecretsFromVault(ctx, client, []string{vpath}, false, false, l)
+	p, err := ParseSecretPath(vpath)
 	if err != nil {
 		return nil, err
 	}
-	for _, v := range m {
-		privkeyb := []byte(v)
-		privkeyb2 := append(bytes.Trim(privkeyb, "\n"), '\n')
-		privkey, err := memguard.NewImmutableFromBytes(privkeyb2)
-		memguard.WipeBytes(privkeyb)
-		if err != nil {
-			return nil, err
+	values, err := ReadSecret(ctx, client, p, l)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.New("private key not found in Vault")
+	}
+	v, err := selectPrivateKey(values)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %s", p.Path, err)
+	}
+	privkeyb := []byte(v)
+	privkeyb2 := append(bytes.Trim(privkeyb, "\n"), '\n')
+	privkey, err := memguard.NewImmutableFromBytes(privkeyb2)
+	memguard.WipeBytes(privkeyb)
+	if err != nil {
+		return nil, err
+	}
+	return privkey, nil
+}
+
+// selectPrivateKey returns the value of the secret that holds the private key.
+func selectPrivateKey(values map[string]string) (string, error) {
+	if len(values) == 1 {
+		for _, v := range values {
+			return v, nil
+		}
+	}
+	if v, ok := values[privateKeyField]; ok {
+		return v, nil
+	}
+	var found []string
+	fields := make([]string, 0, len(values))
+	for k, v := range values {
+		fields = append(fields, k)
+		if isPEMPrivateKey(v) {
+			found = append(found, v)
 		}
-		return privkey, nil
 	}
-	return nil, errors.New("private key not found in Vault")
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	sort.Strings(fields)
+	return "", fmt.Errorf("several fields (%s), choose the private key with #field", strings.Join(fields, ", "))
 }
 
-func GetVaultClient(ctx context.Context, vaultParams params.VaultParams, l *zap.SugaredLogger) (*api.Client, error) {
-	// unset env VAULT_ADDR to prevent the vault client from seeing it
-	_ = os.Unsetenv("VAULT_ADDR")
+func isPEMPrivateKey(v string) bool {
+	v = strings.TrimSpace(v)
+	return strings.HasPrefix(v, "-----BEGIN ") && strings.Contains(v, "PRIVATE KEY-----")
+}
 
-	client, err := vexec.Auth(
-		ctx,
-		vaultParams.AuthMethod,
-		vaultParams.Address,
-		vaultParams.AuthPath,
-		vaultParams.Token,
-		vaultParams.Username,
-		vaultParams.Password,
-		l,
-	)
+// ReadCredentialsFromVault reads the username and password fields of a
+// secret, like the credentials of a proxy.
+func ReadCredentialsFromVault(ctx context.Context, vpath string, client *api.Client, l *zap.SugaredLogger) (string, string, error) {
+	p, err := ParseSecretPath(vpath)
+	if err != nil {
+		return "", "", err
+	}
+	values, err := ReadSecret(ctx, client, p, l)
 	if err != nil {
-		return nil, fmt.Errorf("Vault auth failed: %s", err)
+		return "", "", err
+	}
+	if values == nil {
+		return "", "", fmt.Errorf("secret not found in Vault: %s", p.Path)
 	}
+	username, password := values["username"], values["password"]
+	if username == "" {
+		return "", "", fmt.Errorf("secret %s has no username field", p.Path)
+	}
+	return username, password, nil
+}
+
+func GetVaultClient(ctx context.Context, vaultParams params.VaultParams, l *zap.SugaredLogger) (*api.Client, error) {
+	helper, err := GetTokenHelper(vaultParams.TokenHelper, vaultParams.Address, vaultParams.Namespace)
+	if err != nil {
+		l.Warnw("failed to configure vault token helper", "error", err)
+	}
+	if vaultParams.AuthMethod == "token" && vaultParams.Token == "" && helper != nil {
+		token, err := helper.Get()
+		if err != nil {
+			l.Warnw("failed to get vault token from token helper", "error", err)
+		} else {
+			vaultParams.Token = token
+		}
+	}
+
+	var client *api.Client
+	if vaultParams.AuthMethod != "token" && helper != nil {
+		client, err = storedTokenClient(ctx, vaultParams, helper, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if client == nil {
+		client, err = Auth(ctx, vaultParams, l)
+		if err != nil {
+			return nil, fmt.Errorf("Vault auth failed: %s", err)
+		}
+		if vaultParams.AuthMethod == "token" {
+			err := RefreshToken(ctx, client, l)
+			if err == context.Canceled {
+				return nil, err
+			}
+			if err != nil {
+				l.Warnw("failed to look up vault token", "error", err)
+			}
+		} else if helper != nil {
+			err := helper.Store(client.Token())
+			if err != nil {
+				l.Warnw("failed to store vault token", "error", err)
+			}
+		}
+	}
+
 	err = vexec.CheckHealth(ctx, client)
 	if err != nil {
 		return nil, fmt.Errorf("Vault health check error: %s", err)
@@ -77,23 +182,31 @@ func GetVaultClient(ctx context.Context, vaultParams params.VaultParams, l *zap.
 	return client, nil
 }
 
-func GetVaultParams(c params.CLIContext) params.VaultParams {
-	p := params.VaultParams{
-		SSHMount:   c.VaultSSHMount(),
-		SSHRole:    c.VaultSSHRole(),
-		AuthMethod: strings.ToLower(c.VaultAuthMethod()),
-		AuthPath:   c.VaultAuthPath(),
-		Address:    c.VaultAddress(),
-		Token:      c.VaultToken(),
-		Username:   c.VaultUsername(),
-		Password:   c.VaultPassword(),
-	}
-	if p.AuthMethod == "" {
-		p.AuthMethod = "token"
-	}
-	if p.AuthPath == "" {
-		p.AuthPath = p.AuthMethod
-	}
-	return p
+// storedTokenClient returns a client that uses the token stored by the token
+// helper, or nil if there is no such token or if it has expired.
+func storedTokenClient(ctx context.Context, vaultParams params.VaultParams, helper TokenHelper, l *zap.SugaredLogger) (*api.Client, error) {
+	token, err := helper.Get()
+	if err != nil {
+		l.Warnw("failed to get vault token from token helper", "error", err)
+		return nil, nil
+	}
+	if token == "" {
+		return nil, nil
+	}
+	client, err := newClient(vaultParams)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(token)
+	err = RefreshToken(ctx, client, l)
+	if err == context.Canceled {
+		return nil, err
+	}
+	if err != nil {
+		l.Infow("stored vault token is not valid, login again", "error", err)
+		return nil, nil
+	}
+	l.Debugw("using stored vault token")
+	return client, nil
 }
 
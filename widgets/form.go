@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os/user"
+	"reflect"
 	"strconv"
 	"strings"
 
@@ -13,7 +14,7 @@ import (
 	"github.com/rivo/tview"
 )
 
-var authMethods = []string{"token", "userpass", "ldap", "approle"}
+var authMethods = []string{"token", "userpass", "ldap", "approle", "jwt", "oidc", "kubernetes", "cert"}
 
 func t(s string) string {
 	return strings.TrimSpace(s)
@@ -75,7 +76,7 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 		return field
 	}
 
-	ctx := new(formContext)
+	ctx := &formContext{CLIContext: c}
 
 	login := c.SSHLogin()
 	if login == "" {
@@ -85,10 +86,7 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 		}
 	}
 
-	pkeyPath := c.PrivateKey()
-	if pkeyPath == "" {
-		pkeyPath = "~/.ssh/id_rsa"
-	}
+	pkeyPaths := strings.Join(c.PrivateKeys(), ", ")
 
 	ctx.sshHostField = addInputField("SSH host", c.SSHHost(), 40, nil)
 	ctx.sshPortField = addInputField("SSH port", fmt.Sprintf("%d", c.SSHPort()), 5, tview.InputFieldInteger)
@@ -96,7 +94,7 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 	if sshOptions {
 		ctx.remoteCommandField = addInputField("Remote command", "", 40, nil)
 	}
-	ctx.sshPKeyField = addInputField("SSH private key path", pkeyPath, 40, nil)
+	ctx.sshPKeyField = addInputField("SSH private key paths", pkeyPaths, 40, nil)
 	ctx.sshVPKeyField = addInputField("SSH private key path in Vault", c.VPrivateKey(), 40, nil)
 	ctx.sshPasswordField = addCheckBox("Use SSH password", c.SSHPassword())
 	ctx.sshAgentField = addCheckBox("Use SSH agent", c.SSHAgent())
@@ -104,15 +102,25 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 	if sshOptions {
 		ctx.forceTerminalField = addCheckBox("Force pseudo-terminal", false)
 	}
-	ctx.httpProxyField = addInputField("HTTP proxy", c.HTTPProxy(), 40, nil)
+	ctx.httpProxyField = addInputField("Proxy URL", c.HTTPProxy(), 40, nil)
 	ctx.vaultURLField = addInputField("Vault URL", c.VaultAddress(), 40, nil)
 	ctx.vaultAuthMethodField = addDropDown("Vault authentication method", authMethods, c.VaultAuthMethod())
 	ctx.vaultAuthPathField = addInputField("Vault authentication path", c.VaultAuthPath(), 40, nil)
 	ctx.vaultTokenField = addInputField("Vault token", c.VaultToken(), 32, nil)
+	ctx.vaultAuthRoleField = addInputField("Vault authentication role", c.VaultAuthRole(), 40, nil)
 	ctx.vaultUsernameField = addInputField("Vault username", c.VaultUsername(), 40, nil)
 	ctx.vaultPassField = addPasswordField("Vault password")
+	ctx.vaultJWTField = addPasswordField("Vault JWT")
+	ctx.vaultK8sTokenFileField = addInputField("Kubernetes token file", c.VaultKubernetesTokenFile(), 40, nil)
+	ctx.vaultClientCertField = addInputField("Vault TLS client certificate", c.VaultClientCert(), 40, nil)
+	ctx.vaultClientKeyField = addInputField("Vault TLS client key", c.VaultClientKey(), 40, nil)
 	ctx.vaultSSHMountField = addInputField("Vault SSH mount point", c.VaultSSHMount(), 40, nil)
 	ctx.vaultSSHRoleField = addInputField("Vault SSH role", c.VaultSSHRole(), 40, nil)
+	var saveProfileField *tview.Checkbox
+	if c.Profile() != "" {
+		saveProfileField = addCheckBox(fmt.Sprintf("Save to profile %s", c.Profile()), false)
+	}
+	ctx.initialOptions = ctx.profileOptions()
 
 	var confirm bool
 
@@ -162,30 +170,156 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 	if !confirm {
 		return nil, errors.New("canceled")
 	}
-	//fmt.Println(ctx.VaultAddress())
+	if saveProfileField != nil && saveProfileField.IsChecked() {
+		// only the fields that were modified are saved
+		changes := make(params.Profile)
+		for name, value := range ctx.profileOptions() {
+			if !reflect.DeepEqual(value, ctx.initialOptions[name]) {
+				changes[name] = value
+			}
+		}
+		err := params.SaveProfile(c.ConfigFile(), c.Profile(), changes)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return ctx, nil
 }
 
 type formContext struct {
-	sshHostField         *tview.InputField
-	sshPortField         *tview.InputField
-	sshLoginField        *tview.InputField
-	sshPasswordField     *tview.Checkbox
-	sshAgentField        *tview.Checkbox
-	sshPKeyField         *tview.InputField
-	sshVPKeyField        *tview.InputField
-	insecureField        *tview.Checkbox
-	httpProxyField       *tview.InputField
-	forceTerminalField   *tview.Checkbox
-	remoteCommandField   *tview.InputField
-	vaultURLField        *tview.InputField
-	vaultAuthMethodField *tview.DropDown
-	vaultAuthPathField   *tview.InputField
-	vaultTokenField      *tview.InputField
-	vaultUsernameField   *tview.InputField
-	vaultPassField       *tview.InputField
-	vaultSSHMountField   *tview.InputField
-	vaultSSHRoleField    *tview.InputField
+	params.CLIContext
+	sshHostField           *tview.InputField
+	sshPortField           *tview.InputField
+	sshLoginField          *tview.InputField
+	sshPasswordField       *tview.Checkbox
+	sshAgentField          *tview.Checkbox
+	sshPKeyField           *tview.InputField
+	sshVPKeyField          *tview.InputField
+	insecureField          *tview.Checkbox
+	httpProxyField         *tview.InputField
+	forceTerminalField     *tview.Checkbox
+	remoteCommandField     *tview.InputField
+	vaultURLField          *tview.InputField
+	vaultAuthMethodField   *tview.DropDown
+	vaultAuthPathField     *tview.InputField
+	vaultAuthRoleField     *tview.InputField
+	vaultTokenField        *tview.InputField
+	vaultUsernameField     *tview.InputField
+	vaultPassField         *tview.InputField
+	vaultJWTField          *tview.InputField
+	vaultK8sTokenFileField *tview.InputField
+	vaultClientCertField   *tview.InputField
+	vaultClientKeyField    *tview.InputField
+	vaultSSHMountField     *tview.InputField
+	vaultSSHRoleField      *tview.InputField
+	initialOptions         params.Profile
+	hostContext            params.CLIContext
+}
+
+// forHost returns the context for the host typed in the form, so that the
+// host mapping and ssh_config apply to that host, and not to the host given
+// on the command line.
+func (ctx *formContext) forHost() params.CLIContext {
+	host := ctx.SSHHost()
+	if ctx.hostContext == nil || ctx.hostContext.SSHHost() != host {
+		ctx.hostContext = ctx.CLIContext.ForHost(host)
+	}
+	return ctx.hostContext
+}
+
+// changed tells if the option was modified in the form. Like the command
+// line flags, the modified fields take precedence over the host mapping and
+// ssh_config.
+func (ctx *formContext) changed(name string) bool {
+	return !reflect.DeepEqual(ctx.profileOptions()[name], ctx.initialOptions[name])
+}
+
+// HostMapping returns the host mapping for the host typed in the form.
+func (ctx *formContext) HostMapping() (params.HostMapping, error) {
+	m, err := ctx.forHost().HostMapping()
+	if err != nil {
+		return m, err
+	}
+	if ctx.changed("vault-ssh-mount") {
+		m.Mount = ""
+	}
+	if ctx.changed("vault-ssh-role") {
+		m.Role = ""
+	}
+	if ctx.changed("login") {
+		m.Login = ""
+	}
+	if ctx.changed("ssh-port") {
+		m.Port = 0
+	}
+	if ctx.changed("privkey") {
+		m.Key = ""
+	}
+	return m, nil
+}
+
+// SSHConfig returns the ssh_config options for the host typed in the form.
+func (ctx *formContext) SSHConfig() (params.SSHConfig, error) {
+	config, err := ctx.forHost().SSHConfig()
+	if err != nil {
+		return config, err
+	}
+	if ctx.changed("login") {
+		config.User = ""
+	}
+	if ctx.changed("ssh-port") {
+		config.Port = 0
+	}
+	if ctx.changed("privkey") {
+		config.IdentityFiles = nil
+	}
+	return config, nil
+}
+
+// profileOptions returns the form values to save in the profile. The secrets
+// are not saved, and the empty values are removed from the profile.
+func (ctx *formContext) profileOptions() params.Profile {
+	options := params.Profile{
+		"ssh-port":                    int64(ctx.SSHPort()),
+		"login":                       ctx.SSHLogin(),
+		"vprivkey":                    ctx.VPrivateKey(),
+		"password":                    ctx.SSHPassword(),
+		"agent":                       ctx.SSHAgent(),
+		"insecure":                    ctx.SSHInsecure(),
+		"http-proxy":                  params.WithoutUserinfo(ctx.HTTPProxy()),
+		"vault-address":               ctx.VaultAddress(),
+		"vault-auth-method":           ctx.VaultAuthMethod(),
+		"vault-auth-path":             ctx.VaultAuthPath(),
+		"vault-auth-role":             ctx.VaultAuthRole(),
+		"vault-username":              ctx.VaultUsername(),
+		"vault-kubernetes-token-file": ctx.VaultKubernetesTokenFile(),
+		"vault-client-cert":           ctx.VaultClientCert(),
+		"vault-client-key":            ctx.VaultClientKey(),
+		"vault-ssh-mount":             ctx.VaultSSHMount(),
+		"vault-ssh-role":              ctx.VaultSSHRole(),
+	}
+	var keys []interface{}
+	for _, path := range ctx.PrivateKeys() {
+		keys = append(keys, path)
+	}
+	options["privkey"] = keys
+	for name, value := range options {
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				options[name] = nil
+			}
+		case bool:
+			if !v {
+				options[name] = nil
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				options[name] = nil
+			}
+		}
+	}
+	return options
 }
 
 func (ctx *formContext) VaultAddress() string {
@@ -208,6 +342,10 @@ func (ctx *formContext) VaultAuthPath() string {
 	return t(ctx.vaultAuthPathField.GetText())
 }
 
+func (ctx *formContext) VaultAuthRole() string {
+	return t(ctx.vaultAuthRoleField.GetText())
+}
+
 func (ctx *formContext) VaultUsername() string {
 	return t(ctx.vaultUsernameField.GetText())
 }
@@ -216,6 +354,26 @@ func (ctx *formContext) VaultPassword() string {
 	return t(ctx.vaultPassField.GetText())
 }
 
+func (ctx *formContext) VaultJWT() string {
+	jwt := t(ctx.vaultJWTField.GetText())
+	if jwt == "" {
+		return ctx.CLIContext.VaultJWT()
+	}
+	return jwt
+}
+
+func (ctx *formContext) VaultKubernetesTokenFile() string {
+	return t(ctx.vaultK8sTokenFileField.GetText())
+}
+
+func (ctx *formContext) VaultClientCert() string {
+	return t(ctx.vaultClientCertField.GetText())
+}
+
+func (ctx *formContext) VaultClientKey() string {
+	return t(ctx.vaultClientKeyField.GetText())
+}
+
 func (ctx *formContext) VaultSSHMount() string {
 	return t(ctx.vaultSSHMountField.GetText())
 }
@@ -280,10 +438,55 @@ func (ctx *formContext) ForceTerminal() bool {
 	return false
 }
 
-func (ctx *formContext) PrivateKey() string {
-	return t(ctx.sshPKeyField.GetText())
+func (ctx *formContext) PrivateKeys() []string {
+	var paths []string
+	for _, path := range strings.Split(ctx.sshPKeyField.GetText(), ",") {
+		if t(path) != "" {
+			paths = append(paths, t(path))
+		}
+	}
+	return paths
 }
 
 func (ctx *formContext) VPrivateKey() string {
 	return t(ctx.sshVPKeyField.GetText())
 }
+
+// ForJumpHost keeps the options of the form for the jump hosts, except the
+// options that only concern the target host.
+func (ctx *formContext) ForJumpHost(h params.JumpHost) params.CLIContext {
+	return &jumpFormContext{formContext: ctx, jump: ctx.CLIContext.ForJumpHost(h)}
+}
+
+type jumpFormContext struct {
+	*formContext
+	jump params.CLIContext
+}
+
+func (ctx *jumpFormContext) HostMapping() (params.HostMapping, error) {
+	return ctx.jump.HostMapping()
+}
+
+func (ctx *jumpFormContext) SSHConfig() (params.SSHConfig, error) {
+	return ctx.jump.SSHConfig()
+}
+
+func (ctx *jumpFormContext) SSHCommand() []string {
+	return nil
+}
+
+func (ctx *jumpFormContext) SSHHost() string {
+	return ctx.jump.SSHHost()
+}
+
+func (ctx *jumpFormContext) SSHLogin() string {
+	return ctx.jump.SSHLogin()
+}
+
+func (ctx *jumpFormContext) SSHPort() int {
+	return ctx.jump.SSHPort()
+}
+
+func (ctx *jumpFormContext) ProxyJump() string {
+	return ""
+}